@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"github.com/jamesboyd/mayfly/internal/config"
+	"github.com/spf13/cobra"
+)
+
+// addControlFlags registers the flags selecting and authenticating to the
+// control server, shared by every command that manages tailnet devices.
+func addControlFlags(cmd *cobra.Command) {
+	cmd.Flags().String("control", "", "Control server: tailscale or headscale [$MAYFLY_CONTROL] (default \"tailscale\")")
+	cmd.Flags().String("tailscale-api-key", "", "Tailscale API key [$TAILSCALE_API_KEY]")
+	cmd.Flags().String("tailscale-oauth-client-id", "", "Tailscale OAuth client ID, instead of an API key [$TAILSCALE_OAUTH_CLIENT_ID]")
+	cmd.Flags().String("tailscale-oauth-client-secret", "", "Tailscale OAuth client secret [$TAILSCALE_OAUTH_CLIENT_SECRET]")
+	cmd.Flags().String("tailscale-tailnet", "", "Tailscale tailnet name [$TAILSCALE_TAILNET]")
+	cmd.Flags().String("headscale-url", "", "Headscale server URL [$HEADSCALE_URL]")
+	cmd.Flags().String("headscale-api-key", "", "Headscale API key [$HEADSCALE_API_KEY]")
+	cmd.Flags().String("headscale-user", "", "Headscale user that owns the nodes [$HEADSCALE_USER]")
+}
+
+// controlConfig reads the flags registered by addControlFlags into cfg.
+func controlConfig(cmd *cobra.Command, cfg *config.Config) {
+	cfg.Control = flagOrEnv(cmd, "control", "MAYFLY_CONTROL", config.ControlTailscale)
+	cfg.TailscaleAPIKey = flagOrEnv(cmd, "tailscale-api-key", "TAILSCALE_API_KEY", "")
+	cfg.TailscaleOAuthClientID = flagOrEnv(cmd, "tailscale-oauth-client-id", "TAILSCALE_OAUTH_CLIENT_ID", "")
+	cfg.TailscaleOAuthClientSecret = flagOrEnv(cmd, "tailscale-oauth-client-secret", "TAILSCALE_OAUTH_CLIENT_SECRET", "")
+	cfg.TailscaleTailnet = flagOrEnv(cmd, "tailscale-tailnet", "TAILSCALE_TAILNET", "")
+	cfg.HeadscaleURL = flagOrEnv(cmd, "headscale-url", "HEADSCALE_URL", "")
+	cfg.HeadscaleAPIKey = flagOrEnv(cmd, "headscale-api-key", "HEADSCALE_API_KEY", "")
+	cfg.HeadscaleUser = flagOrEnv(cmd, "headscale-user", "HEADSCALE_USER", "")
+}
@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/jamesboyd/mayfly/internal/config"
+	"github.com/jamesboyd/mayfly/internal/runner"
+	"github.com/spf13/cobra"
+)
+
+var downCmd = &cobra.Command{
+	Use:   "down [node]",
+	Short: "Tear down a running exit node",
+	Long:  "Tear down a node by name or instance ID. The node may be omitted when only one\nis running. If the `mayfly up` process managing it is still running, it is\nsignalled to tear down instead.",
+	Args:  cobra.MaximumNArgs(1),
+	RunE:  runDown,
+}
+
+func init() {
+	addControlFlags(downCmd)
+	addProviderFlags(downCmd)
+
+	rootCmd.AddCommand(downCmd)
+}
+
+func runDown(cmd *cobra.Command, args []string) error {
+	cfg := &config.Config{}
+	controlConfig(cmd, cfg)
+	providerConfig(cmd, cfg)
+
+	if err := cfg.ValidateControl(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return runner.Down(cmd.Context(), cfg, nodeArg(args))
+}
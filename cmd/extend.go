@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jamesboyd/mayfly/internal/config"
+	"github.com/jamesboyd/mayfly/internal/runner"
+	"github.com/spf13/cobra"
+)
+
+var extendCmd = &cobra.Command{
+	Use:   "extend [node] +<duration>",
+	Short: "Push out the TTL deadline of a running node",
+	Long:  "Extend a node's deadline without re-provisioning it, so it keeps its IP. The\nnode may be omitted when only one is running. The node's total lifetime stays\nwithin the --max-lifetime it was launched with. Example: mayfly extend +30m",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE:  runExtend,
+}
+
+func init() {
+	addProviderFlags(extendCmd)
+
+	rootCmd.AddCommand(extendCmd)
+}
+
+func runExtend(cmd *cobra.Command, args []string) error {
+	by, err := time.ParseDuration(strings.TrimPrefix(args[len(args)-1], "+"))
+	if err != nil || by <= 0 {
+		return fmt.Errorf("invalid extension %q: expected a positive duration like +30m", args[len(args)-1])
+	}
+
+	cfg := &config.Config{}
+	providerConfig(cmd, cfg)
+
+	return runner.Extend(cmd.Context(), cfg, nodeArg(args[:len(args)-1]), by)
+}
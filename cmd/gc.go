@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/jamesboyd/mayfly/internal/config"
+	"github.com/jamesboyd/mayfly/internal/runner"
+	"github.com/spf13/cobra"
+)
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Find and delete leaked mayfly resources across all regions",
+	Long:  "Scan every enabled AWS region for mayfly-tagged instances, security groups and\nauth key parameters, IAM for mayfly's instance profiles and roles, the Hetzner\nCloud project (with --hcloud-token) for mayfly-labelled servers and firewalls,\nand the tailnet for mayfly-* devices, that no live node accounts for.\nShows the plan and deletes the resources after confirmation.",
+	RunE:  runGC,
+}
+
+func init() {
+	gcCmd.Flags().String("region", "", "AWS region used to list enabled regions [$AWS_REGION] (default \"us-east-1\")")
+	addControlFlags(gcCmd)
+	addProviderFlags(gcCmd)
+	gcCmd.Flags().Bool("dry-run", false, "Show what would be deleted without deleting anything")
+
+	rootCmd.AddCommand(gcCmd)
+}
+
+func runGC(cmd *cobra.Command, args []string) error {
+	cfg := &config.Config{
+		Region: flagOrEnv(cmd, "region", "AWS_REGION", "us-east-1"),
+	}
+	controlConfig(cmd, cfg)
+	providerConfig(cmd, cfg)
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+	if err := cfg.ValidateControl(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return runner.GC(cmd.Context(), cfg, dryRun)
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/jamesboyd/mayfly/internal/config"
+	"github.com/jamesboyd/mayfly/internal/runner"
+	"github.com/jamesboyd/mayfly/internal/userdata"
+	"github.com/spf13/cobra"
+)
+
+var imageCmd = &cobra.Command{
+	Use:   "image",
+	Short: "Build and prune pre-baked mayfly AMIs",
+	Long:  "Pre-baked AMIs carry a pinned Tailscale version, forwarding sysctls and\nhardening, so nodes launched from them skip installing Tailscale at boot.",
+}
+
+var imageBuildCmd = &cobra.Command{
+	Use:   "build",
+	Short: "Build a private mayfly AMI that new nodes launch from",
+	RunE:  runImageBuild,
+}
+
+var imagePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Deregister old mayfly AMIs and delete their snapshots",
+	RunE:  runImagePrune,
+}
+
+func init() {
+	imageBuildCmd.Flags().String("region", "", "AWS region [$AWS_REGION] (default \"us-east-1\")")
+	imageBuildCmd.Flags().String("image", "", "Operating system to build from: al2023, ubuntu-24.04 or debian-12 [$MAYFLY_IMAGE] (default \"al2023\")")
+	imageBuildCmd.Flags().String("instance-type", "", "Builder instance type, whose architecture the AMI gets [$MAYFLY_INSTANCE_TYPE] (default \"t4g.micro\" where offered, else \"t3.micro\")")
+	imageBuildCmd.Flags().String("tailscale-version", "", fmt.Sprintf("Tailscale version to install [$MAYFLY_TAILSCALE_VERSION] (default %q)", userdata.DefaultTailscaleVersion))
+	addNetworkFlags(imageBuildCmd)
+
+	imagePruneCmd.Flags().String("region", "", "AWS region [$AWS_REGION] (default \"us-east-1\")")
+	imagePruneCmd.Flags().Int("keep", 1, "Number of newest images to keep per OS and architecture")
+	imagePruneCmd.Flags().Bool("dry-run", false, "Show what would be deleted without deleting anything")
+
+	imageCmd.AddCommand(imageBuildCmd, imagePruneCmd)
+	rootCmd.AddCommand(imageCmd)
+}
+
+func runImageBuild(cmd *cobra.Command, args []string) error {
+	cfg := &config.Config{
+		Region:           flagOrEnv(cmd, "region", "AWS_REGION", "us-east-1"),
+		Image:            flagOrEnv(cmd, "image", "MAYFLY_IMAGE", userdata.AL2023),
+		InstanceType:     flagOrEnv(cmd, "instance-type", "MAYFLY_INSTANCE_TYPE", ""),
+		TailscaleVersion: flagOrEnv(cmd, "tailscale-version", "MAYFLY_TAILSCALE_VERSION", userdata.DefaultTailscaleVersion),
+	}
+	networkConfig(cmd, cfg)
+
+	if err := cfg.ValidateImageBuild(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return runner.BuildImage(cmd.Context(), cfg)
+}
+
+func runImagePrune(cmd *cobra.Command, args []string) error {
+	cfg := &config.Config{
+		Region: flagOrEnv(cmd, "region", "AWS_REGION", "us-east-1"),
+	}
+	keep, _ := cmd.Flags().GetInt("keep")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+	if keep < 0 {
+		return fmt.Errorf("invalid configuration: keep must not be negative")
+	}
+
+	return runner.PruneImages(cmd.Context(), cfg, keep, dryRun)
+}
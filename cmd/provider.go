@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"github.com/jamesboyd/mayfly/internal/config"
+	"github.com/spf13/cobra"
+)
+
+// addProviderFlags registers the cloud provider credentials needed by every
+// command that touches a node's instance. AWS credentials come from the
+// usual AWS config instead.
+func addProviderFlags(cmd *cobra.Command) {
+	cmd.Flags().String("hcloud-token", "", "Hetzner Cloud API token [$HCLOUD_TOKEN]")
+}
+
+// providerConfig reads the flags registered by addProviderFlags into cfg.
+func providerConfig(cmd *cobra.Command, cfg *config.Config) {
+	cfg.HetznerToken = flagOrEnv(cmd, "hcloud-token", "HCLOUD_TOKEN", "")
+}
+
+// addNetworkFlags registers the AWS network placement flags for commands that
+// launch instances.
+func addNetworkFlags(cmd *cobra.Command) {
+	cmd.Flags().String("vpc-id", "", "Launch in this VPC instead of the default VPC [$MAYFLY_VPC_ID]")
+	cmd.Flags().String("subnet-id", "", "Launch in this public subnet [$MAYFLY_SUBNET_ID]")
+	cmd.Flags().String("subnet-tag", "", "Launch in a public subnet tagged key=value or key [$MAYFLY_SUBNET_TAG]")
+}
+
+// networkConfig reads the flags registered by addNetworkFlags into cfg.
+func networkConfig(cmd *cobra.Command, cfg *config.Config) {
+	cfg.VPCID = flagOrEnv(cmd, "vpc-id", "MAYFLY_VPC_ID", "")
+	cfg.SubnetID = flagOrEnv(cmd, "subnet-id", "MAYFLY_SUBNET_ID", "")
+	cfg.SubnetTag = flagOrEnv(cmd, "subnet-tag", "MAYFLY_SUBNET_TAG", "")
+}
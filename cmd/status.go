@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/jamesboyd/mayfly/internal/config"
+	"github.com/jamesboyd/mayfly/internal/runner"
+	"github.com/spf13/cobra"
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status [node]",
+	Short: "Show running exit nodes and their remaining TTL",
+	Long:  "Show live details of a node by name or instance ID, or of every node if none\nis given.",
+	Args:  cobra.MaximumNArgs(1),
+	RunE:  runStatus,
+}
+
+func init() {
+	addControlFlags(statusCmd)
+	addProviderFlags(statusCmd)
+
+	rootCmd.AddCommand(statusCmd)
+}
+
+func runStatus(cmd *cobra.Command, args []string) error {
+	cfg := &config.Config{}
+	controlConfig(cmd, cfg)
+	providerConfig(cmd, cfg)
+
+	if err := cfg.ValidateControl(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return runner.Status(cmd.Context(), cfg, nodeArg(args))
+}
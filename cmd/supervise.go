@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/jamesboyd/mayfly/internal/config"
+	"github.com/jamesboyd/mayfly/internal/runner"
+	"github.com/spf13/cobra"
+)
+
+// superviseCmd is started in the background by `mayfly up --detach`.
+var superviseCmd = &cobra.Command{
+	Use:    "supervise <node>",
+	Short:  "Watch a node's TTL and tear it down at the deadline",
+	Hidden: true,
+	Args:   cobra.ExactArgs(1),
+	RunE:   runSupervise,
+}
+
+func init() {
+	rootCmd.AddCommand(superviseCmd)
+}
+
+func runSupervise(cmd *cobra.Command, args []string) error {
+	cfg := &config.Config{}
+	controlConfig(cmd, cfg)
+	providerConfig(cmd, cfg)
+
+	if err := cfg.ValidateControl(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return runner.Supervise(cmd.Context(), cfg, args[0])
+}
@@ -3,10 +3,12 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/jamesboyd/mayfly/internal/config"
 	"github.com/jamesboyd/mayfly/internal/runner"
+	"github.com/jamesboyd/mayfly/internal/userdata"
 	"github.com/spf13/cobra"
 )
 
@@ -23,32 +25,73 @@ var upCmd = &cobra.Command{
 }
 
 func init() {
-	upCmd.Flags().String("region", "", "AWS region [$AWS_REGION] (default \"us-east-1\")")
+	upCmd.Flags().String("provider", "", "Cloud provider: aws or hetzner [$MAYFLY_PROVIDER] (default \"aws\")")
+	upCmd.Flags().String("region", "", "AWS region [$AWS_REGION] or Hetzner location [$HCLOUD_LOCATION] (default \"us-east-1\" or \"fsn1\")")
 	upCmd.Flags().Duration("ttl", 0, "Time to live [$MAYFLY_TTL] (default \"1h\")")
-	upCmd.Flags().String("instance-type", "", "EC2 instance type [$MAYFLY_INSTANCE_TYPE] (default \"t3.micro\")")
-	upCmd.Flags().String("tailscale-auth-key", "", "Tailscale auth key [$TAILSCALE_AUTH_KEY]")
-	upCmd.Flags().String("tailscale-api-key", "", "Tailscale API key [$TAILSCALE_API_KEY]")
-	upCmd.Flags().String("tailscale-tailnet", "", "Tailscale tailnet name [$TAILSCALE_TAILNET]")
+	upCmd.Flags().String("instance-type", "", "Instance or server type [$MAYFLY_INSTANCE_TYPE] (default \"t4g.micro\" where offered, else \"t3.micro\"; \"cpx11\" on Hetzner)")
+	upCmd.Flags().String("image", "", "Operating system (al2023, ubuntu-24.04, debian-12) or a custom AMI ID [$MAYFLY_IMAGE] (default \"al2023\" or \"ubuntu-24.04\")")
+	upCmd.Flags().String("image-os", "", "Operating system a custom AMI runs, which picks its bootstrap script [$MAYFLY_IMAGE_OS]")
+	upCmd.Flags().String("user-data-append", "", "Comma-separated files to append to the node's user-data as cloud-init parts [$MAYFLY_USER_DATA_APPEND]")
+	upCmd.Flags().String("tailscale-version", "", fmt.Sprintf("Tailscale version to install [$MAYFLY_TAILSCALE_VERSION] (default %q)", userdata.DefaultTailscaleVersion))
+	addProviderFlags(upCmd)
+	addNetworkFlags(upCmd)
+	upCmd.Flags().Bool("spot", false, "Run on spot capacity, falling back to on-demand if there is none")
+	upCmd.Flags().String("spot-max-price", "", "Maximum spot price in USD per hour [$MAYFLY_SPOT_MAX_PRICE] (default: the on-demand price)")
+	upCmd.Flags().String("tailscale-auth-key", "", "Tailscale auth key; one is created per node if unset [$TAILSCALE_AUTH_KEY]")
+	upCmd.Flags().String("tags", "", "Comma-separated ACL tags the node advertises and its auth key carries, e.g. tag:exit [$MAYFLY_TAGS]")
+	upCmd.Flags().Bool("check-policy", false, "Check that the tailnet policy auto-approves the node as an exit node before launch")
+	addControlFlags(upCmd)
+	upCmd.Flags().Duration("max-lifetime", 0, "Maximum total lifetime of a node, including extensions [$MAYFLY_MAX_LIFETIME] (default \"12h\")")
+	upCmd.Flags().Bool("detach", false, "Hand the TTL watch to a background supervisor and exit")
 
 	rootCmd.AddCommand(upCmd)
 }
 
 func runUp(cmd *cobra.Command, args []string) error {
-	region := flagOrEnv(cmd, "region", "AWS_REGION", "us-east-1")
+	provider := flagOrEnv(cmd, "provider", "MAYFLY_PROVIDER", config.ProviderAWS)
+	var region, instanceType, image string
+	if provider == config.ProviderHetzner {
+		region = flagOrEnv(cmd, "region", "HCLOUD_LOCATION", "fsn1")
+		instanceType = flagOrEnv(cmd, "instance-type", "MAYFLY_INSTANCE_TYPE", "cpx11")
+		image = flagOrEnv(cmd, "image", "MAYFLY_IMAGE", userdata.Ubuntu2404)
+	} else {
+		region = flagOrEnv(cmd, "region", "AWS_REGION", "us-east-1")
+		// Left empty, the cheapest default the region offers is picked at launch.
+		instanceType = flagOrEnv(cmd, "instance-type", "MAYFLY_INSTANCE_TYPE", "")
+		image = flagOrEnv(cmd, "image", "MAYFLY_IMAGE", userdata.AL2023)
+	}
+	imageOS := flagOrEnv(cmd, "image-os", "MAYFLY_IMAGE_OS", "")
+	userDataAppend := splitList(flagOrEnv(cmd, "user-data-append", "MAYFLY_USER_DATA_APPEND", ""))
+	tailscaleVersion := flagOrEnv(cmd, "tailscale-version", "MAYFLY_TAILSCALE_VERSION", userdata.DefaultTailscaleVersion)
 	ttl := flagDurationOrEnv(cmd, "ttl", "MAYFLY_TTL", 1*time.Hour)
-	instanceType := flagOrEnv(cmd, "instance-type", "MAYFLY_INSTANCE_TYPE", "t3.micro")
+	spot, _ := cmd.Flags().GetBool("spot")
+	spotMaxPrice := flagOrEnv(cmd, "spot-max-price", "MAYFLY_SPOT_MAX_PRICE", "")
 	tsAuthKey := flagOrEnv(cmd, "tailscale-auth-key", "TAILSCALE_AUTH_KEY", "")
-	tsAPIKey := flagOrEnv(cmd, "tailscale-api-key", "TAILSCALE_API_KEY", "")
-	tsTailnet := flagOrEnv(cmd, "tailscale-tailnet", "TAILSCALE_TAILNET", "")
+	tags := splitList(flagOrEnv(cmd, "tags", "MAYFLY_TAGS", ""))
+	maxLifetime := flagDurationOrEnv(cmd, "max-lifetime", "MAYFLY_MAX_LIFETIME", config.DefaultMaxLifetime)
+	detach, _ := cmd.Flags().GetBool("detach")
+	checkPolicy, _ := cmd.Flags().GetBool("check-policy")
 
 	cfg := &config.Config{
+		Provider:         provider,
 		Region:           region,
 		TTL:              ttl,
 		InstanceType:     instanceType,
+		Image:            image,
+		ImageOS:          imageOS,
+		TailscaleVersion: tailscaleVersion,
+		UserDataAppend:   userDataAppend,
+		Spot:             spot,
+		SpotMaxPrice:     spotMaxPrice,
 		TailscaleAuthKey: tsAuthKey,
-		TailscaleAPIKey:  tsAPIKey,
-		TailscaleTailnet: tsTailnet,
+		Tags:             tags,
+		CheckPolicy:      checkPolicy,
+		Detach:           detach,
+		MaxLifetime:      maxLifetime,
 	}
+	controlConfig(cmd, cfg)
+	providerConfig(cmd, cfg)
+	networkConfig(cmd, cfg)
 
 	if err := cfg.Validate(); err != nil {
 		return fmt.Errorf("invalid configuration: %w", err)
@@ -73,6 +116,25 @@ func flagOrEnv(cmd *cobra.Command, flag, env, fallback string) string {
 	return fallback
 }
 
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// nodeArg returns the optional node name or instance ID argument.
+func nodeArg(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
+
 func flagDurationOrEnv(cmd *cobra.Command, flag, env string, fallback time.Duration) time.Duration {
 	if cmd.Flags().Changed(flag) {
 		v, _ := cmd.Flags().GetDuration(flag)
@@ -3,22 +3,120 @@ package aws
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 )
 
-const al2023AMIParameter = "/aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-x86_64"
+// SSM parameters holding the latest AMI of a distribution, formatted with the
+// architecture as the publisher names it.
+const (
+	al2023AMIParameter = "/aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-%s"
+	ubuntuAMIParameter = "/aws/service/canonical/ubuntu/server/24.04/stable/current/%s/hvm/ebs-gp3/ami-id"
+)
+
+// debianOwner is the account Debian publishes its official AMIs from.
+const debianOwner = "136693071363"
+
+// LookupImage returns the AMI to launch on the instance type. For a named
+// distribution ("al2023", "ubuntu-24.04" or "debian-12") that is the newest
+// image built for it by `mayfly image build`, falling back to the latest
+// release, in either case for the instance type's architecture. A given AMI
+// ID is returned once its architecture is checked against the instance type.
+func (p *Provider) LookupImage(ctx context.Context, image, instanceType string) (string, error) {
+	arch, err := p.architecture(ctx, instanceType)
+	if err != nil {
+		return "", err
+	}
+
+	if !strings.HasPrefix(image, "ami-") {
+		id, err := p.builtImage(ctx, image, arch)
+		if err != nil || id != "" {
+			return id, err
+		}
+	}
+	return p.releaseImage(ctx, image, arch)
+}
+
+// LookupReleaseImage returns the latest release AMI of a named distribution
+// for the instance type's architecture, ignoring any mayfly-built images.
+func (p *Provider) LookupReleaseImage(ctx context.Context, image, instanceType string) (string, error) {
+	arch, err := p.architecture(ctx, instanceType)
+	if err != nil {
+		return "", err
+	}
+	return p.releaseImage(ctx, image, arch)
+}
+
+func (p *Provider) releaseImage(ctx context.Context, image, arch string) (string, error) {
+	switch {
+	case image == "al2023":
+		return p.ssmImage(ctx, fmt.Sprintf(al2023AMIParameter, arch))
+	case image == "ubuntu-24.04":
+		return p.ssmImage(ctx, fmt.Sprintf(ubuntuAMIParameter, debianArch(arch)))
+	case image == "debian-12":
+		return p.latestOwnedImage(ctx, debianOwner, "debian-12-"+debianArch(arch)+"-*", arch)
+	case strings.HasPrefix(image, "ami-"):
+		return p.checkImage(ctx, image, arch)
+	}
+	return "", fmt.Errorf("unknown image %q", image)
+}
+
+// debianArch returns the Debian name of an EC2 architecture.
+func debianArch(arch string) string {
+	if arch == string(types.ArchitectureTypeX8664) {
+		return "amd64"
+	}
+	return arch
+}
 
-func LookupAMI(ctx context.Context, cfg aws.Config) (string, error) {
-	client := ssm.NewFromConfig(cfg)
+func (p *Provider) ssmImage(ctx context.Context, parameter string) (string, error) {
+	out, err := p.ssm.GetParameter(ctx, &ssm.GetParameterInput{
+		Name: aws.String(parameter),
+	})
+	if err != nil {
+		return "", fmt.Errorf("looking up AMI: %w", err)
+	}
+	return aws.ToString(out.Parameter.Value), nil
+}
 
-	out, err := client.GetParameter(ctx, &ssm.GetParameterInput{
-		Name: aws.String(al2023AMIParameter),
+// latestOwnedImage returns the newest available AMI owned by the account
+// whose name matches the pattern.
+func (p *Provider) latestOwnedImage(ctx context.Context, owner, namePattern, arch string) (string, error) {
+	out, err := p.ec2.DescribeImages(ctx, &ec2.DescribeImagesInput{
+		Owners: []string{owner},
+		Filters: []types.Filter{
+			{Name: aws.String("name"), Values: []string{namePattern}},
+			{Name: aws.String("architecture"), Values: []string{arch}},
+			{Name: aws.String("state"), Values: []string{"available"}},
+		},
 	})
 	if err != nil {
 		return "", fmt.Errorf("looking up AMI: %w", err)
 	}
+	if len(out.Images) == 0 {
+		return "", fmt.Errorf("no %s AMI named %s from owner %s", arch, namePattern, owner)
+	}
+	return newestImage(out.Images), nil
+}
 
-	return aws.ToString(out.Parameter.Value), nil
+// checkImage confirms a custom AMI exists and matches the instance type's
+// architecture, which RunInstances would otherwise reject only at launch.
+func (p *Provider) checkImage(ctx context.Context, imageID, arch string) (string, error) {
+	out, err := p.ec2.DescribeImages(ctx, &ec2.DescribeImagesInput{
+		ImageIds: []string{imageID},
+	})
+	if err != nil {
+		return "", fmt.Errorf("describing AMI %s: %w", imageID, err)
+	}
+	if len(out.Images) == 0 {
+		return "", fmt.Errorf("AMI %s not found", imageID)
+	}
+	if got := string(out.Images[0].Architecture); got != arch {
+		return "", fmt.Errorf("AMI %s is %s but the instance type is %s", imageID, got, arch)
+	}
+	return imageID, nil
 }
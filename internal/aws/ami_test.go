@@ -0,0 +1,94 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// amiStub answers DescribeInstanceTypes for t4g.micro (arm64) and
+// DescribeImages from a fixed catalogue, in which "self" owns the images
+// tagged with an OS.
+func amiStub(t *testing.T) *Provider {
+	t.Helper()
+
+	type image struct{ id, owner, name, arch, created, os string }
+	images := []image{
+		{"ami-deb-old", debianOwner, "debian-12-arm64-20250101", "arm64", "2025-01-01T00:00:00.000Z", ""},
+		{"ami-deb-new", debianOwner, "debian-12-arm64-20250601", "arm64", "2025-06-01T00:00:00.000Z", ""},
+		{"ami-custom", "111122223333", "my-exit-node", "x86_64", "2025-03-01T00:00:00.000Z", ""},
+		{"ami-built-old", "self", "mayfly-image-debian-12-1", "arm64", "2025-04-01T00:00:00.000Z", "debian-12"},
+		{"ami-built-new", "self", "mayfly-image-debian-12-2", "arm64", "2025-05-01T00:00:00.000Z", "debian-12"},
+		{"ami-built-x86", "self", "mayfly-image-debian-12-3", "x86_64", "2025-07-01T00:00:00.000Z", "debian-12"},
+	}
+
+	// matches applies the filters LookupImage uses.
+	matches := func(img image, form url.Values) bool {
+		for i := 1; form.Get(fmt.Sprintf("Filter.%d.Name", i)) != ""; i++ {
+			value := form.Get(fmt.Sprintf("Filter.%d.Value.1", i))
+			switch form.Get(fmt.Sprintf("Filter.%d.Name", i)) {
+			case "tag:" + ImageTag:
+				if img.os != value {
+					return false
+				}
+			case "architecture":
+				if img.arch != value {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	return stubEC2(t, func(action string, form url.Values) string {
+		var b strings.Builder
+		switch action {
+		case "DescribeInstanceTypes":
+			b.WriteString("<DescribeInstanceTypesResponse><instanceTypeSet><item><instanceType>t4g.micro</instanceType>" +
+				"<processorInfo><supportedArchitectures><item>arm64</item></supportedArchitectures></processorInfo>" +
+				"</item></instanceTypeSet></DescribeInstanceTypesResponse>")
+		case "DescribeImages":
+			b.WriteString("<DescribeImagesResponse><imagesSet>")
+			for _, img := range images {
+				if id := form.Get("ImageId.1"); id != "" && id != img.id {
+					continue
+				}
+				if owner := form.Get("Owner.1"); owner != "" && owner != img.owner {
+					continue
+				}
+				if !matches(img, form) {
+					continue
+				}
+				fmt.Fprintf(&b, "<item><imageId>%s</imageId><name>%s</name><architecture>%s</architecture><creationDate>%s</creationDate></item>",
+					img.id, img.name, img.arch, img.created)
+			}
+			b.WriteString("</imagesSet></DescribeImagesResponse>")
+		default:
+			t.Errorf("unexpected EC2 action %s", action)
+		}
+		return b.String()
+	})
+}
+
+func TestLookupImage(t *testing.T) {
+	p := amiStub(t)
+	ctx := context.Background()
+
+	if got, err := p.LookupImage(ctx, "debian-12", "t4g.micro"); err != nil || got != "ami-built-new" {
+		t.Errorf("LookupImage(debian-12) = %s, %v, want the newest arm64 mayfly image ami-built-new", got, err)
+	}
+	if got, err := p.LookupReleaseImage(ctx, "debian-12", "t4g.micro"); err != nil || got != "ami-deb-new" {
+		t.Errorf("LookupReleaseImage(debian-12) = %s, %v, want the newest Debian AMI ami-deb-new", got, err)
+	}
+	if _, err := p.LookupImage(ctx, "ami-custom", "t4g.micro"); err == nil || !strings.Contains(err.Error(), "x86_64") {
+		t.Errorf("LookupImage(ami-custom) error = %v, want an architecture mismatch", err)
+	}
+	if _, err := p.LookupImage(ctx, "ami-missing", "t4g.micro"); err == nil {
+		t.Error("LookupImage succeeded for a missing AMI")
+	}
+	if _, err := p.LookupImage(ctx, "windows-2022", "t4g.micro"); err == nil {
+		t.Error("LookupImage succeeded for an unknown image")
+	}
+}
@@ -0,0 +1,37 @@
+package aws
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/smithy-go"
+)
+
+// ConsoleOutput returns the instance's serial console output. Nitro instances
+// report it live; older instance types only report the buffered output EC2
+// captured, which can lag by several minutes.
+func (p *Provider) ConsoleOutput(ctx context.Context, instanceID string) (string, error) {
+	input := &ec2.GetConsoleOutputInput{
+		InstanceId: aws.String(instanceID),
+		Latest:     aws.Bool(true),
+	}
+	out, err := p.ec2.GetConsoleOutput(ctx, input)
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "UnsupportedOperation" {
+		input.Latest = nil
+		out, err = p.ec2.GetConsoleOutput(ctx, input)
+	}
+	if err != nil {
+		return "", fmt.Errorf("getting console output: %w", err)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(aws.ToString(out.Output))
+	if err != nil {
+		return "", fmt.Errorf("decoding console output: %w", err)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,28 @@
+package aws
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"testing"
+)
+
+func TestConsoleOutput(t *testing.T) {
+	const console = "mayfly-stage: forwarding-enabled\n"
+	p := stubEC2(t, func(action string, form url.Values) string {
+		if action != "GetConsoleOutput" || form.Get("InstanceId") != "i-0abc" || form.Get("Latest") != "true" {
+			t.Errorf("unexpected call %s %v", action, form)
+		}
+		return fmt.Sprintf(`<GetConsoleOutputResponse><instanceId>i-0abc</instanceId><output>%s</output></GetConsoleOutputResponse>`,
+			base64.StdEncoding.EncodeToString([]byte(console)))
+	})
+
+	got, err := p.ConsoleOutput(context.Background(), "i-0abc")
+	if err != nil {
+		t.Fatalf("ConsoleOutput: %v", err)
+	}
+	if got != console {
+		t.Errorf("ConsoleOutput = %q, want %q", got, console)
+	}
+}
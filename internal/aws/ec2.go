@@ -2,23 +2,27 @@ package aws
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+
+	"github.com/jamesboyd/mayfly/internal/cloud"
 )
 
-// Resources tracks everything we create so teardown knows what to clean up.
-type Resources struct {
-	InstanceID      string
-	SecurityGroupID string
-	PublicIP        string
-}
+// DeadlineTag is the instance tag holding the node's TTL deadline (RFC 3339).
+const DeadlineTag = "mayfly-deadline"
 
-func getDefaultVPC(ctx context.Context, client *ec2.Client) (string, error) {
-	out, err := client.DescribeVpcs(ctx, &ec2.DescribeVpcsInput{
+// CreatedTag is the security group tag holding when it was created (RFC 3339),
+// which EC2 doesn't record for security groups itself.
+const CreatedTag = "mayfly-created"
+
+func (p *Provider) getDefaultVPC(ctx context.Context) (string, error) {
+	out, err := p.ec2.DescribeVpcs(ctx, &ec2.DescribeVpcsInput{
 		Filters: []types.Filter{
 			{Name: aws.String("isDefault"), Values: []string{"true"}},
 		},
@@ -27,15 +31,13 @@ func getDefaultVPC(ctx context.Context, client *ec2.Client) (string, error) {
 		return "", fmt.Errorf("describing VPCs: %w", err)
 	}
 	if len(out.Vpcs) == 0 {
-		return "", fmt.Errorf("no default VPC found — Mayfly requires a default VPC")
+		return "", fmt.Errorf("no default VPC found — pick a VPC or subnet with --vpc-id, --subnet-id or --subnet-tag")
 	}
 	return aws.ToString(out.Vpcs[0].VpcId), nil
 }
 
-func createSecurityGroup(ctx context.Context, client *ec2.Client, vpcID string) (string, error) {
-	name := fmt.Sprintf("mayfly-%d", time.Now().UnixMilli())
-
-	sg, err := client.CreateSecurityGroup(ctx, &ec2.CreateSecurityGroupInput{
+func (p *Provider) createSecurityGroup(ctx context.Context, vpcID, name string) (string, error) {
+	sg, err := p.ec2.CreateSecurityGroup(ctx, &ec2.CreateSecurityGroupInput{
 		GroupName:   aws.String(name),
 		Description: aws.String("Mayfly ephemeral exit node - safe to delete"),
 		VpcId:       aws.String(vpcID),
@@ -45,6 +47,7 @@ func createSecurityGroup(ctx context.Context, client *ec2.Client, vpcID string)
 				Tags: []types.Tag{
 					{Key: aws.String("Name"), Value: aws.String(name)},
 					{Key: aws.String("mayfly"), Value: aws.String("true")},
+					{Key: aws.String(CreatedTag), Value: aws.String(time.Now().UTC().Format(time.RFC3339))},
 				},
 			},
 		},
@@ -55,7 +58,7 @@ func createSecurityGroup(ctx context.Context, client *ec2.Client, vpcID string)
 
 	sgID := aws.ToString(sg.GroupId)
 
-	_, err = client.AuthorizeSecurityGroupIngress(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
+	_, err = p.ec2.AuthorizeSecurityGroupIngress(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
 		GroupId: aws.String(sgID),
 		IpPermissions: []types.IpPermission{
 			{
@@ -73,49 +76,104 @@ func createSecurityGroup(ctx context.Context, client *ec2.Client, vpcID string)
 	return sgID, nil
 }
 
-// Provision creates a security group and launches an EC2 instance.
-// It returns a Resources struct for teardown. If provisioning fails partway,
-// the caller should still call Teardown with whatever Resources were populated.
-func Provision(ctx context.Context, cfg aws.Config, amiID, instanceType, userData string) (*Resources, error) {
-	client := ec2.NewFromConfig(cfg)
-	res := &Resources{}
+// MaxUserData returns the 16 KiB of user-data EC2 accepts.
+func (p *Provider) MaxUserData() int {
+	return 16 * 1024
+}
+
+// Provision creates a security group and launches an EC2 instance, both named
+// after the node. The instance terminates itself when shut down, and carries
+// its deadline in the DeadlineTag tag, readable from instance metadata by the
+// self-destruct timer. With spec.Spot it asks for spot capacity first and
+// falls back to on-demand if there is none. It returns a Resources struct
+// for teardown. If provisioning fails partway, the caller should still call
+// Teardown with whatever Resources were populated.
+func (p *Provider) Provision(ctx context.Context, spec cloud.Spec) (*cloud.Resources, error) {
+	return p.launch(ctx, spec, types.ShutdownBehaviorTerminate)
+}
+
+// launch creates the security group and instance for Provision and
+// LaunchBuilder, which differ only in what a shutdown from inside the
+// instance does.
+func (p *Provider) launch(ctx context.Context, spec cloud.Spec, shutdown types.ShutdownBehavior) (*cloud.Resources, error) {
+	res := &cloud.Resources{}
 
-	vpcID, err := getDefaultVPC(ctx, client)
+	net, err := p.resolveNetwork(ctx)
 	if err != nil {
 		return res, err
 	}
 
-	sgID, err := createSecurityGroup(ctx, client, vpcID)
+	sgID, err := p.createSecurityGroup(ctx, net.vpcID, spec.Name)
 	res.SecurityGroupID = sgID
 	if err != nil {
 		return res, err
 	}
 
-	runOut, err := client.RunInstances(ctx, &ec2.RunInstancesInput{
-		ImageId:      aws.String(amiID),
-		InstanceType: types.InstanceType(instanceType),
-		MinCount:     aws.Int32(1),
-		MaxCount:     aws.Int32(1),
-		SecurityGroupIds: []string{sgID},
-		UserData:     aws.String(userData),
+	input := &ec2.RunInstancesInput{
+		ImageId:                           aws.String(spec.ImageID),
+		InstanceType:                      types.InstanceType(spec.InstanceType),
+		MinCount:                          aws.Int32(1),
+		MaxCount:                          aws.Int32(1),
+		UserData:                          aws.String(spec.UserData),
+		InstanceInitiatedShutdownBehavior: shutdown,
+		MetadataOptions: &types.InstanceMetadataOptionsRequest{
+			HttpTokens:           types.HttpTokensStateRequired,
+			InstanceMetadataTags: types.InstanceMetadataTagsStateEnabled,
+		},
 		TagSpecifications: []types.TagSpecification{
 			{
 				ResourceType: types.ResourceTypeInstance,
 				Tags: []types.Tag{
-					{Key: aws.String("Name"), Value: aws.String("mayfly-exit")},
+					{Key: aws.String("Name"), Value: aws.String(spec.Name)},
 					{Key: aws.String("mayfly"), Value: aws.String("true")},
+					{Key: aws.String(DeadlineTag), Value: aws.String(spec.Deadline.UTC().Format(time.RFC3339))},
 				},
 			},
 		},
-	})
+	}
+	if net.publicIP {
+		// The subnet doesn't hand out public IPs, so ask for one on the
+		// primary interface. The security group then belongs there too.
+		input.NetworkInterfaces = []types.InstanceNetworkInterfaceSpecification{{
+			DeviceIndex:              aws.Int32(0),
+			SubnetId:                 aws.String(net.subnetID),
+			Groups:                   []string{sgID},
+			AssociatePublicIpAddress: aws.Bool(true),
+		}}
+	} else {
+		input.SecurityGroupIds = []string{sgID}
+		if net.subnetID != "" {
+			input.SubnetId = aws.String(net.subnetID)
+		}
+	}
+
+	if spec.Spot {
+		input.InstanceMarketOptions = spotOptions(spec.SpotMaxPrice)
+	}
+
+	if spec.AuthKey != "" {
+		if err := p.storeAuthKey(ctx, spec, res); err != nil {
+			return res, err
+		}
+		input.IamInstanceProfile = &types.IamInstanceProfileSpecification{
+			Name: aws.String(res.InstanceProfile),
+		}
+	}
+
+	runOut, err := p.runInstances(ctx, input)
+	if err != nil && spec.Spot && isSpotUnavailable(err) {
+		input.InstanceMarketOptions = nil
+		runOut, err = p.runInstances(ctx, input)
+	}
 	if err != nil {
 		return res, fmt.Errorf("launching instance: %w", err)
 	}
+	res.Spot = input.InstanceMarketOptions != nil
 
 	res.InstanceID = aws.ToString(runOut.Instances[0].InstanceId)
 
 	// Wait for instance to reach running state.
-	waiter := ec2.NewInstanceRunningWaiter(client)
+	waiter := ec2.NewInstanceRunningWaiter(p.ec2)
 	err = waiter.Wait(ctx, &ec2.DescribeInstancesInput{
 		InstanceIds: []string{res.InstanceID},
 	}, 5*time.Minute)
@@ -124,32 +182,75 @@ func Provision(ctx context.Context, cfg aws.Config, amiID, instanceType, userDat
 	}
 
 	// Fetch the public IP now that the instance is running.
-	desc, err := client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
-		InstanceIds: []string{res.InstanceID},
-	})
-	if err == nil && len(desc.Reservations) > 0 && len(desc.Reservations[0].Instances) > 0 {
-		res.PublicIP = aws.ToString(desc.Reservations[0].Instances[0].PublicIpAddress)
+	if inst, err := p.Describe(ctx, res.InstanceID); err == nil {
+		res.PublicIP = inst.PublicIP
 	}
 
 	return res, nil
 }
 
-// Teardown terminates the instance and deletes the security group.
-// It uses context.Background() internally so cleanup always completes.
-func Teardown(cfg aws.Config, res *Resources) error {
-	ctx := context.Background()
-	client := ec2.NewFromConfig(cfg)
+// runInstances calls RunInstances, retrying while a just-created instance
+// profile is not yet visible to EC2.
+func (p *Provider) runInstances(ctx context.Context, input *ec2.RunInstancesInput) (*ec2.RunInstancesOutput, error) {
+	deadline := time.Now().Add(profileRetryTimeout)
+	for {
+		out, err := p.ec2.RunInstances(ctx, input)
+		if err == nil || input.IamInstanceProfile == nil || !isProfilePropagating(err) || time.Now().After(deadline) {
+			return out, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(profileRetryInterval):
+		}
+	}
+}
+
+// spotOptions requests a one-time spot instance that is terminated, not
+// stopped or hibernated, when interrupted.
+func spotOptions(maxPrice string) *types.InstanceMarketOptionsRequest {
+	opts := &types.SpotMarketOptions{
+		SpotInstanceType:             types.SpotInstanceTypeOneTime,
+		InstanceInterruptionBehavior: types.InstanceInterruptionBehaviorTerminate,
+	}
+	if maxPrice != "" {
+		opts.MaxPrice = aws.String(maxPrice)
+	}
+	return &types.InstanceMarketOptionsRequest{
+		MarketType:  types.MarketTypeSpot,
+		SpotOptions: opts,
+	}
+}
+
+// isSpotUnavailable reports whether RunInstances failed because there is no
+// spot capacity to be had, as opposed to a problem on-demand would share.
+func isSpotUnavailable(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "InsufficientInstanceCapacity", "SpotMaxPriceTooLow", "MaxSpotInstanceCountExceeded":
+		return true
+	}
+	return false
+}
+
+// Teardown terminates the instance and deletes the security group, then the
+// instance profile and auth key parameter if there are any.
+// Pass context.Background() so cleanup always completes.
+func (p *Provider) Teardown(ctx context.Context, res *cloud.Resources) error {
 	var firstErr error
 
 	if res.InstanceID != "" {
-		_, err := client.TerminateInstances(ctx, &ec2.TerminateInstancesInput{
+		_, err := p.ec2.TerminateInstances(ctx, &ec2.TerminateInstancesInput{
 			InstanceIds: []string{res.InstanceID},
 		})
 		if err != nil {
 			firstErr = fmt.Errorf("terminating instance: %w", err)
 		} else {
 			// Wait for termination before deleting the SG (SG can't be deleted while in use).
-			waiter := ec2.NewInstanceTerminatedWaiter(client)
+			waiter := ec2.NewInstanceTerminatedWaiter(p.ec2)
 			if err := waiter.Wait(ctx, &ec2.DescribeInstancesInput{
 				InstanceIds: []string{res.InstanceID},
 			}, 5*time.Minute); err != nil {
@@ -161,7 +262,7 @@ func Teardown(cfg aws.Config, res *Resources) error {
 	}
 
 	if res.SecurityGroupID != "" {
-		_, err := client.DeleteSecurityGroup(ctx, &ec2.DeleteSecurityGroupInput{
+		_, err := p.ec2.DeleteSecurityGroup(ctx, &ec2.DeleteSecurityGroupInput{
 			GroupId: aws.String(res.SecurityGroupID),
 		})
 		if err != nil && firstErr == nil {
@@ -169,5 +270,60 @@ func Teardown(cfg aws.Config, res *Resources) error {
 		}
 	}
 
+	if res.InstanceProfile != "" {
+		if err := p.deleteInstanceProfile(ctx, res.InstanceProfile); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if res.AuthKeyParameter != "" {
+		if err := p.deleteAuthKey(ctx, res.AuthKeyParameter); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
 	return firstErr
 }
+
+// Describe returns the current state and public IP of an instance.
+func (p *Provider) Describe(ctx context.Context, instanceID string) (*cloud.Instance, error) {
+	out, err := p.ec2.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{instanceID},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("describing instance: %w", err)
+	}
+	if len(out.Reservations) == 0 || len(out.Reservations[0].Instances) == 0 {
+		return nil, fmt.Errorf("instance %s not found", instanceID)
+	}
+
+	inst := out.Reservations[0].Instances[0]
+	res := &cloud.Instance{
+		PublicIP:   aws.ToString(inst.PublicIpAddress),
+		LaunchTime: aws.ToTime(inst.LaunchTime),
+	}
+	if inst.State != nil {
+		res.State = string(inst.State.Name)
+		switch inst.State.Name {
+		case types.InstanceStateNameShuttingDown, types.InstanceStateNameTerminated,
+			types.InstanceStateNameStopping, types.InstanceStateNameStopped:
+			res.Gone = true
+		}
+	}
+	return res, nil
+}
+
+// SetDeadline updates the instance's deadline tag, which its self-destruct
+// timer re-reads on every check.
+func (p *Provider) SetDeadline(ctx context.Context, instanceID string, deadline time.Time) error {
+	_, err := p.ec2.CreateTags(ctx, &ec2.CreateTagsInput{
+		Resources: []string{instanceID},
+		Tags: []types.Tag{
+			{Key: aws.String(DeadlineTag), Value: aws.String(deadline.UTC().Format(time.RFC3339))},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("updating deadline tag: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/smithy-go"
+)
+
+// stubEC2 returns a Provider whose EC2 calls are answered by respond, which
+// gets the query action and form and returns the XML response body.
+func stubEC2(t *testing.T, respond func(action string, form url.Values) string, opts ...Option) *Provider {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		body := respond(r.Form.Get("Action"), r.Form)
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(srv.Close)
+
+	return NewFromConfig(aws.Config{
+		Region:       "us-west-2",
+		BaseEndpoint: aws.String(srv.URL),
+		Credentials:  aws.AnonymousCredentials{},
+	}, opts...)
+}
+
+func TestIsSpotUnavailable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&smithy.GenericAPIError{Code: "InsufficientInstanceCapacity"}, true},
+		{fmt.Errorf("operation error: %w", &smithy.GenericAPIError{Code: "SpotMaxPriceTooLow"}), true},
+		{&smithy.GenericAPIError{Code: "MaxSpotInstanceCountExceeded"}, true},
+		{&smithy.GenericAPIError{Code: "UnauthorizedOperation"}, false},
+		{errors.New("connection refused"), false},
+	}
+	for _, tt := range tests {
+		if got := isSpotUnavailable(tt.err); got != tt.want {
+			t.Errorf("isSpotUnavailable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestSpotOptions(t *testing.T) {
+	if opts := spotOptions(""); opts.SpotOptions.MaxPrice != nil {
+		t.Errorf("MaxPrice = %q, want unset", aws.ToString(opts.SpotOptions.MaxPrice))
+	}
+	opts := spotOptions("0.005")
+	if got := aws.ToString(opts.SpotOptions.MaxPrice); got != "0.005" {
+		t.Errorf("MaxPrice = %q, want 0.005", got)
+	}
+	if opts.SpotOptions.InstanceInterruptionBehavior != "terminate" {
+		t.Errorf("InstanceInterruptionBehavior = %q, want terminate", opts.SpotOptions.InstanceInterruptionBehavior)
+	}
+}
@@ -0,0 +1,173 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+
+	"github.com/jamesboyd/mayfly/internal/cloud"
+)
+
+// Tags on AMIs built by `mayfly image build`. ImageTag holds the OS the
+// image was built from.
+const (
+	ImageTag            = "mayfly-image"
+	TailscaleVersionTag = "mayfly-tailscale-version"
+)
+
+// Image is an AMI built by `mayfly image build`.
+type Image struct {
+	ID               string
+	Name             string
+	OS               string
+	Architecture     string
+	TailscaleVersion string
+	State            string // "pending", "available", "failed", ...
+	Created          time.Time
+	SnapshotIDs      []string
+}
+
+// LaunchBuilder launches an instance to build an image from, like Provision
+// except that a shutdown from inside the instance stops it rather than
+// terminating it, so its volume can be snapshotted.
+func (p *Provider) LaunchBuilder(ctx context.Context, spec cloud.Spec) (*cloud.Resources, error) {
+	return p.launch(ctx, spec, types.ShutdownBehaviorStop)
+}
+
+// WaitStopped waits for an instance to power itself off.
+func (p *Provider) WaitStopped(ctx context.Context, instanceID string, timeout time.Duration) error {
+	waiter := ec2.NewInstanceStoppedWaiter(p.ec2)
+	if err := waiter.Wait(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{instanceID},
+	}, timeout); err != nil {
+		return fmt.Errorf("waiting for instance to stop: %w", err)
+	}
+	return nil
+}
+
+// CreateImage snapshots a stopped builder instance into a private AMI tagged
+// with the OS and Tailscale version it carries, and waits until the AMI is
+// available.
+func (p *Provider) CreateImage(ctx context.Context, instanceID, name, os, tailscaleVersion string, timeout time.Duration) (string, error) {
+	tags := []types.Tag{
+		{Key: aws.String("Name"), Value: aws.String(name)},
+		{Key: aws.String(ImageTag), Value: aws.String(os)},
+		{Key: aws.String(TailscaleVersionTag), Value: aws.String(tailscaleVersion)},
+	}
+	out, err := p.ec2.CreateImage(ctx, &ec2.CreateImageInput{
+		InstanceId:  aws.String(instanceID),
+		Name:        aws.String(name),
+		Description: aws.String(fmt.Sprintf("Mayfly exit node image: %s with Tailscale %s", os, tailscaleVersion)),
+		TagSpecifications: []types.TagSpecification{
+			{ResourceType: types.ResourceTypeImage, Tags: tags},
+			{ResourceType: types.ResourceTypeSnapshot, Tags: tags},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("creating image: %w", err)
+	}
+
+	imageID := aws.ToString(out.ImageId)
+	waiter := ec2.NewImageAvailableWaiter(p.ec2)
+	if err := waiter.Wait(ctx, &ec2.DescribeImagesInput{
+		ImageIds: []string{imageID},
+	}, timeout); err != nil {
+		return imageID, fmt.Errorf("waiting for image %s: %w", imageID, err)
+	}
+	return imageID, nil
+}
+
+// ListImages returns the account's mayfly-built AMIs in the provider's
+// region, newest first.
+func (p *Provider) ListImages(ctx context.Context) ([]Image, error) {
+	out, err := p.ec2.DescribeImages(ctx, &ec2.DescribeImagesInput{
+		Owners:  []string{"self"},
+		Filters: []types.Filter{{Name: aws.String("tag-key"), Values: []string{ImageTag}}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("describing images: %w", err)
+	}
+
+	images := make([]Image, 0, len(out.Images))
+	for _, img := range out.Images {
+		im := Image{
+			ID:           aws.ToString(img.ImageId),
+			Name:         aws.ToString(img.Name),
+			Architecture: string(img.Architecture),
+			State:        string(img.State),
+		}
+		im.Created, _ = time.Parse(time.RFC3339, aws.ToString(img.CreationDate))
+		for _, t := range img.Tags {
+			switch aws.ToString(t.Key) {
+			case ImageTag:
+				im.OS = aws.ToString(t.Value)
+			case TailscaleVersionTag:
+				im.TailscaleVersion = aws.ToString(t.Value)
+			}
+		}
+		for _, bdm := range img.BlockDeviceMappings {
+			if bdm.Ebs != nil && bdm.Ebs.SnapshotId != nil {
+				im.SnapshotIDs = append(im.SnapshotIDs, aws.ToString(bdm.Ebs.SnapshotId))
+			}
+		}
+		images = append(images, im)
+	}
+
+	sort.Slice(images, func(i, j int) bool { return images[i].Created.After(images[j].Created) })
+	return images, nil
+}
+
+// DeleteImage deregisters an AMI and deletes its snapshots, which would
+// otherwise keep being billed.
+func (p *Provider) DeleteImage(ctx context.Context, img Image) error {
+	if _, err := p.ec2.DeregisterImage(ctx, &ec2.DeregisterImageInput{
+		ImageId: aws.String(img.ID),
+	}); err != nil {
+		return fmt.Errorf("deregistering image %s: %w", img.ID, err)
+	}
+	for _, id := range img.SnapshotIDs {
+		if _, err := p.ec2.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{
+			SnapshotId: aws.String(id),
+		}); err != nil {
+			return fmt.Errorf("deleting snapshot %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// builtImage returns the newest available mayfly-built AMI for the OS and
+// architecture, or "" if there is none.
+func (p *Provider) builtImage(ctx context.Context, os, arch string) (string, error) {
+	out, err := p.ec2.DescribeImages(ctx, &ec2.DescribeImagesInput{
+		Owners: []string{"self"},
+		Filters: []types.Filter{
+			{Name: aws.String("tag:" + ImageTag), Values: []string{os}},
+			{Name: aws.String("architecture"), Values: []string{arch}},
+			{Name: aws.String("state"), Values: []string{"available"}},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("looking up mayfly images: %w", err)
+	}
+	return newestImage(out.Images), nil
+}
+
+// newestImage returns the ID of the most recently created image, or "".
+// CreationDate is RFC 3339, so it sorts as a string.
+func newestImage(images []types.Image) string {
+	var newest *types.Image
+	for i := range images {
+		if newest == nil || aws.ToString(images[i].CreationDate) > aws.ToString(newest.CreationDate) {
+			newest = &images[i]
+		}
+	}
+	if newest == nil {
+		return ""
+	}
+	return aws.ToString(newest.ImageId)
+}
@@ -0,0 +1,63 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// defaultInstanceTypes are tried in order by DefaultInstanceType. Graviton
+// is cheaper for the same size but isn't offered in every region.
+var defaultInstanceTypes = []string{"t4g.micro", "t3.micro"}
+
+// DefaultInstanceType returns the first of the default instance types the
+// region offers.
+func (p *Provider) DefaultInstanceType(ctx context.Context) (string, error) {
+	out, err := p.ec2.DescribeInstanceTypeOfferings(ctx, &ec2.DescribeInstanceTypeOfferingsInput{
+		LocationType: types.LocationTypeRegion,
+		Filters: []types.Filter{
+			{Name: aws.String("instance-type"), Values: defaultInstanceTypes},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("describing instance type offerings: %w", err)
+	}
+
+	offered := make([]string, 0, len(out.InstanceTypeOfferings))
+	for _, o := range out.InstanceTypeOfferings {
+		offered = append(offered, string(o.InstanceType))
+	}
+	for _, t := range defaultInstanceTypes {
+		if slices.Contains(offered, t) {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("none of %s is offered in this region — pick one with --instance-type", strings.Join(defaultInstanceTypes, ", "))
+}
+
+// architecture returns the CPU architecture of an instance type, named as
+// in the Amazon Linux AMI parameters: "x86_64" or "arm64".
+func (p *Provider) architecture(ctx context.Context, instanceType string) (string, error) {
+	out, err := p.ec2.DescribeInstanceTypes(ctx, &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: []types.InstanceType{types.InstanceType(instanceType)},
+	})
+	if err != nil {
+		return "", fmt.Errorf("describing instance type %s: %w", instanceType, err)
+	}
+	if len(out.InstanceTypes) == 0 || out.InstanceTypes[0].ProcessorInfo == nil {
+		return "", fmt.Errorf("instance type %s is not offered in this region", instanceType)
+	}
+
+	archs := out.InstanceTypes[0].ProcessorInfo.SupportedArchitectures
+	for _, arch := range []types.ArchitectureType{types.ArchitectureTypeX8664, types.ArchitectureTypeArm64} {
+		if slices.Contains(archs, arch) {
+			return string(arch), nil
+		}
+	}
+	return "", fmt.Errorf("instance type %s has no supported architecture (%v)", instanceType, archs)
+}
@@ -0,0 +1,81 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDefaultInstanceType(t *testing.T) {
+	tests := []struct {
+		name    string
+		offered []string
+		want    string
+	}{
+		{"graviton offered", []string{"t3.micro", "t4g.micro"}, "t4g.micro"},
+		{"x86 only", []string{"t3.micro"}, "t3.micro"},
+		{"neither", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := stubEC2(t, func(action string, form url.Values) string {
+				if action != "DescribeInstanceTypeOfferings" {
+					t.Errorf("unexpected EC2 action %s", action)
+				}
+				var b strings.Builder
+				b.WriteString("<DescribeInstanceTypeOfferingsResponse><instanceTypeOfferingSet>")
+				for _, it := range tt.offered {
+					fmt.Fprintf(&b, "<item><instanceType>%s</instanceType><locationType>region</locationType><location>us-west-2</location></item>", it)
+				}
+				b.WriteString("</instanceTypeOfferingSet></DescribeInstanceTypeOfferingsResponse>")
+				return b.String()
+			})
+
+			got, err := p.DefaultInstanceType(context.Background())
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("DefaultInstanceType = %s, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("DefaultInstanceType = %s, %v, want %s", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestArchitecture(t *testing.T) {
+	archs := map[string][]string{
+		"t4g.nano": {"arm64"},
+		"t3.micro": {"x86_64"},
+		"t2.micro": {"i386", "x86_64"},
+	}
+	p := stubEC2(t, func(action string, form url.Values) string {
+		if action != "DescribeInstanceTypes" {
+			t.Errorf("unexpected EC2 action %s", action)
+		}
+		var b strings.Builder
+		b.WriteString("<DescribeInstanceTypesResponse><instanceTypeSet>")
+		if it := form.Get("InstanceType.1"); archs[it] != nil {
+			fmt.Fprintf(&b, "<item><instanceType>%s</instanceType><processorInfo><supportedArchitectures>", it)
+			for _, a := range archs[it] {
+				fmt.Fprintf(&b, "<item>%s</item>", a)
+			}
+			b.WriteString("</supportedArchitectures></processorInfo></item>")
+		}
+		b.WriteString("</instanceTypeSet></DescribeInstanceTypesResponse>")
+		return b.String()
+	})
+
+	for it, want := range map[string]string{"t4g.nano": "arm64", "t3.micro": "x86_64", "t2.micro": "x86_64"} {
+		if got, err := p.architecture(context.Background(), it); err != nil || got != want {
+			t.Errorf("architecture(%s) = %s, %v, want %s", it, got, err, want)
+		}
+	}
+	if _, err := p.architecture(context.Background(), "x9.huge"); err == nil {
+		t.Error("architecture(x9.huge) succeeded for a type the region doesn't offer")
+	}
+}
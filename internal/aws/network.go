@@ -0,0 +1,144 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// Network selects where instances launch. The zero value means the default
+// VPC and its default subnets.
+type Network struct {
+	VPCID    string
+	SubnetID string
+	// SubnetTag discovers a public subnet by tag, as "key=value" or "key".
+	SubnetTag string
+}
+
+// placement is a resolved Network.
+type placement struct {
+	vpcID    string
+	subnetID string // empty to let EC2 pick a default subnet
+	// publicIP is set when the subnet doesn't assign public IPs on launch, so
+	// one must be requested on the network interface.
+	publicIP bool
+}
+
+// resolveNetwork turns the configured Network into a VPC and subnet, checking
+// that the subnet can reach the internet.
+func (p *Provider) resolveNetwork(ctx context.Context) (*placement, error) {
+	n := p.network
+	if n == (Network{}) {
+		vpcID, err := p.getDefaultVPC(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &placement{vpcID: vpcID}, nil
+	}
+
+	input := &ec2.DescribeSubnetsInput{}
+	switch {
+	case n.SubnetID != "":
+		input.SubnetIds = []string{n.SubnetID}
+	case n.SubnetTag != "":
+		key, value, hasValue := strings.Cut(n.SubnetTag, "=")
+		if hasValue {
+			input.Filters = append(input.Filters, types.Filter{Name: aws.String("tag:" + key), Values: []string{value}})
+		} else {
+			input.Filters = append(input.Filters, types.Filter{Name: aws.String("tag-key"), Values: []string{key}})
+		}
+	}
+	if n.VPCID != "" {
+		input.Filters = append(input.Filters, types.Filter{Name: aws.String("vpc-id"), Values: []string{n.VPCID}})
+	}
+
+	out, err := p.ec2.DescribeSubnets(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("describing subnets: %w", err)
+	}
+	if len(out.Subnets) == 0 {
+		return nil, fmt.Errorf("no subnet matches %s", describeNetwork(n))
+	}
+
+	// An explicit subnet must be public; otherwise take the first public one.
+	var lastErr error
+	for _, subnet := range out.Subnets {
+		if err := p.checkInternetRoute(ctx, subnet); err != nil {
+			lastErr = err
+			continue
+		}
+		return &placement{
+			vpcID:    aws.ToString(subnet.VpcId),
+			subnetID: aws.ToString(subnet.SubnetId),
+			publicIP: !aws.ToBool(subnet.MapPublicIpOnLaunch),
+		}, nil
+	}
+	if len(out.Subnets) == 1 {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("none of the %d subnets matching %s routes to an internet gateway — an exit node needs a public subnet (a 0.0.0.0/0 route to an igw-)", len(out.Subnets), describeNetwork(n))
+}
+
+// checkInternetRoute returns an error unless the subnet's route table (its
+// own, or else the VPC's main one) sends 0.0.0.0/0 to an internet gateway.
+func (p *Provider) checkInternetRoute(ctx context.Context, subnet types.Subnet) error {
+	subnetID := aws.ToString(subnet.SubnetId)
+
+	out, err := p.ec2.DescribeRouteTables(ctx, &ec2.DescribeRouteTablesInput{
+		Filters: []types.Filter{
+			{Name: aws.String("association.subnet-id"), Values: []string{subnetID}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("describing route tables: %w", err)
+	}
+	if len(out.RouteTables) == 0 {
+		out, err = p.ec2.DescribeRouteTables(ctx, &ec2.DescribeRouteTablesInput{
+			Filters: []types.Filter{
+				{Name: aws.String("vpc-id"), Values: []string{aws.ToString(subnet.VpcId)}},
+				{Name: aws.String("association.main"), Values: []string{"true"}},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("describing route tables: %w", err)
+		}
+	}
+
+	for _, rt := range out.RouteTables {
+		if routesToInternetGateway(rt) {
+			return nil
+		}
+	}
+	return fmt.Errorf("subnet %s has no route to an internet gateway — an exit node needs a public subnet, so add a 0.0.0.0/0 route to an igw- or pick another subnet", subnetID)
+}
+
+// routesToInternetGateway reports whether a route table has an active default
+// route to an internet gateway.
+func routesToInternetGateway(rt types.RouteTable) bool {
+	for _, r := range rt.Routes {
+		if aws.ToString(r.DestinationCidrBlock) == "0.0.0.0/0" &&
+			strings.HasPrefix(aws.ToString(r.GatewayId), "igw-") &&
+			r.State != types.RouteStateBlackhole {
+			return true
+		}
+	}
+	return false
+}
+
+func describeNetwork(n Network) string {
+	var parts []string
+	if n.SubnetID != "" {
+		parts = append(parts, "subnet "+n.SubnetID)
+	}
+	if n.SubnetTag != "" {
+		parts = append(parts, "tag "+n.SubnetTag)
+	}
+	if n.VPCID != "" {
+		parts = append(parts, "VPC "+n.VPCID)
+	}
+	return strings.Join(parts, " in ")
+}
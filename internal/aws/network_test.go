@@ -0,0 +1,120 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// subnet is a subnet served by the stub EC2 endpoint. gateway is the target
+// of the default route in its own route table ("" for no route table).
+type subnet struct {
+	id, vpc   string
+	mapPublic bool
+	gateway   string
+}
+
+// newStubProvider returns a Provider whose EC2 calls are answered from the
+// given subnets. The VPC's main route table has no internet route.
+func newStubProvider(t *testing.T, n Network, subnets ...subnet) *Provider {
+	t.Helper()
+
+	return stubEC2(t, func(action string, form url.Values) string {
+		var b strings.Builder
+		switch action {
+		case "DescribeSubnets":
+			b.WriteString("<DescribeSubnetsResponse><subnetSet>")
+			for _, s := range subnets {
+				if id := form.Get("SubnetId.1"); id != "" && id != s.id {
+					continue
+				}
+				fmt.Fprintf(&b, "<item><subnetId>%s</subnetId><vpcId>%s</vpcId><mapPublicIpOnLaunch>%t</mapPublicIpOnLaunch></item>", s.id, s.vpc, s.mapPublic)
+			}
+			b.WriteString("</subnetSet></DescribeSubnetsResponse>")
+		case "DescribeRouteTables":
+			b.WriteString("<DescribeRouteTablesResponse><routeTableSet>")
+			if form.Get("Filter.1.Name") == "association.subnet-id" {
+				for _, s := range subnets {
+					if s.id == form.Get("Filter.1.Value.1") && s.gateway != "" {
+						fmt.Fprintf(&b, "<item><routeSet><item><destinationCidrBlock>0.0.0.0/0</destinationCidrBlock><gatewayId>%s</gatewayId><state>active</state></item></routeSet></item>", s.gateway)
+					}
+				}
+			} else {
+				b.WriteString("<item><routeSet><item><destinationCidrBlock>10.0.0.0/16</destinationCidrBlock><gatewayId>local</gatewayId><state>active</state></item></routeSet></item>")
+			}
+			b.WriteString("</routeTableSet></DescribeRouteTablesResponse>")
+		default:
+			t.Errorf("unexpected EC2 action %s", action)
+		}
+		return b.String()
+	}, WithNetwork(n))
+}
+
+func TestResolveNetwork(t *testing.T) {
+	tests := []struct {
+		name    string
+		network Network
+		subnets []subnet
+		want    placement
+		wantErr string
+	}{
+		{
+			name:    "public subnet assigning IPs",
+			network: Network{SubnetID: "subnet-a"},
+			subnets: []subnet{{id: "subnet-a", vpc: "vpc-1", mapPublic: true, gateway: "igw-1"}},
+			want:    placement{vpcID: "vpc-1", subnetID: "subnet-a"},
+		},
+		{
+			name:    "public subnet without auto-assigned IPs",
+			network: Network{SubnetID: "subnet-a"},
+			subnets: []subnet{{id: "subnet-a", vpc: "vpc-1", gateway: "igw-1"}},
+			want:    placement{vpcID: "vpc-1", subnetID: "subnet-a", publicIP: true},
+		},
+		{
+			name:    "private subnet",
+			network: Network{SubnetID: "subnet-a"},
+			subnets: []subnet{{id: "subnet-a", vpc: "vpc-1", gateway: "nat-1"}},
+			wantErr: "subnet subnet-a has no route to an internet gateway",
+		},
+		{
+			name:    "tag picks the public subnet",
+			network: Network{SubnetTag: "tier=public"},
+			subnets: []subnet{
+				{id: "subnet-a", vpc: "vpc-1"},
+				{id: "subnet-b", vpc: "vpc-1", mapPublic: true, gateway: "igw-1"},
+			},
+			want: placement{vpcID: "vpc-1", subnetID: "subnet-b"},
+		},
+		{
+			name:    "no public subnet in VPC",
+			network: Network{VPCID: "vpc-1"},
+			subnets: []subnet{{id: "subnet-a", vpc: "vpc-1"}, {id: "subnet-b", vpc: "vpc-1"}},
+			wantErr: "none of the 2 subnets matching VPC vpc-1 routes to an internet gateway",
+		},
+		{
+			name:    "no match",
+			network: Network{SubnetTag: "tier=public"},
+			wantErr: "no subnet matches tag tier=public",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newStubProvider(t, tt.network, tt.subnets...)
+			got, err := p.resolveNetwork(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("resolveNetwork error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveNetwork: %v", err)
+			}
+			if *got != tt.want {
+				t.Errorf("resolveNetwork = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+
+	"github.com/jamesboyd/mayfly/internal/cloud"
+)
+
+// Provider is the EC2 implementation of cloud.Provider for one region.
+type Provider struct {
+	ec2     *ec2.Client
+	ssm     *ssm.Client
+	iam     *iam.Client
+	region  string
+	network Network
+}
+
+var (
+	_ cloud.Provider            = (*Provider)(nil)
+	_ cloud.InstanceTypeChooser = (*Provider)(nil)
+	_ cloud.ConsoleReader       = (*Provider)(nil)
+	_ cloud.SecretStore         = (*Provider)(nil)
+)
+
+// Option configures a Provider.
+type Option func(*Provider)
+
+// WithNetwork launches instances in the given VPC or subnet instead of the
+// default VPC.
+func WithNetwork(n Network) Option {
+	return func(p *Provider) {
+		p.network = n
+	}
+}
+
+// New loads the default AWS configuration for the region and returns a Provider.
+func New(ctx context.Context, region string, opts ...Option) (*Provider, error) {
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("loading AWS config: %w", err)
+	}
+	return NewFromConfig(cfg, opts...), nil
+}
+
+// NewFromConfig returns a Provider using an already loaded AWS configuration.
+func NewFromConfig(cfg aws.Config, opts ...Option) *Provider {
+	p := &Provider{
+		ec2:    ec2.NewFromConfig(cfg),
+		ssm:    ssm.NewFromConfig(cfg),
+		iam:    iam.NewFromConfig(cfg),
+		region: cfg.Region,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
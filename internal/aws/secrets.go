@@ -0,0 +1,179 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	iamtypes "github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/smithy-go"
+
+	"github.com/jamesboyd/mayfly/internal/cloud"
+)
+
+// iamPath groups the roles and instance profiles mayfly creates.
+const iamPath = "/mayfly/"
+
+// profileRetryInterval and profileRetryTimeout bound how long a launch waits
+// for a new instance profile to become visible to EC2, which can take
+// several seconds after IAM has created it.
+var (
+	profileRetryInterval = 5 * time.Second
+	profileRetryTimeout  = time.Minute
+)
+
+// AuthKeyParameter returns the SSM parameter the named node's auth key is
+// stored in. Only the node's instance role may read or delete it.
+func (p *Provider) AuthKeyParameter(name string) string {
+	return "/mayfly/" + name + "/auth-key"
+}
+
+// InstanceProfileName returns the name of the named node's instance profile
+// and of the role in it.
+func InstanceProfileName(name string) string {
+	return name
+}
+
+// storeAuthKey writes the auth key to a SecureString parameter, then creates
+// an instance profile whose role may read and delete only that parameter.
+// res is filled in as each resource is created, so Teardown can remove a
+// partial set.
+func (p *Provider) storeAuthKey(ctx context.Context, spec cloud.Spec, res *cloud.Resources) error {
+	param := p.AuthKeyParameter(spec.Name)
+	_, err := p.ssm.PutParameter(ctx, &ssm.PutParameterInput{
+		Name:        aws.String(param),
+		Value:       aws.String(spec.AuthKey),
+		Type:        ssmtypes.ParameterTypeSecureString,
+		Description: aws.String("Tailscale auth key for mayfly node " + spec.Name),
+		Tags:        []ssmtypes.Tag{{Key: aws.String("mayfly"), Value: aws.String("true")}},
+	})
+	if err != nil {
+		return fmt.Errorf("storing auth key: %w", err)
+	}
+	res.AuthKeyParameter = param
+
+	name := InstanceProfileName(spec.Name)
+	_, err = p.iam.CreateRole(ctx, &iam.CreateRoleInput{
+		RoleName:                 aws.String(name),
+		Path:                     aws.String(iamPath),
+		AssumeRolePolicyDocument: aws.String(ec2TrustPolicy),
+		Description:              aws.String("Lets mayfly node " + spec.Name + " fetch its auth key"),
+		Tags:                     []iamtypes.Tag{{Key: aws.String("mayfly"), Value: aws.String("true")}},
+	})
+	if err != nil {
+		return fmt.Errorf("creating instance role: %w", err)
+	}
+	res.InstanceProfile = name
+
+	policy, err := authKeyPolicy(p.region, param)
+	if err != nil {
+		return err
+	}
+	_, err = p.iam.PutRolePolicy(ctx, &iam.PutRolePolicyInput{
+		RoleName:       aws.String(name),
+		PolicyName:     aws.String("auth-key"),
+		PolicyDocument: aws.String(policy),
+	})
+	if err != nil {
+		return fmt.Errorf("granting access to auth key: %w", err)
+	}
+
+	_, err = p.iam.CreateInstanceProfile(ctx, &iam.CreateInstanceProfileInput{
+		InstanceProfileName: aws.String(name),
+		Path:                aws.String(iamPath),
+		Tags:                []iamtypes.Tag{{Key: aws.String("mayfly"), Value: aws.String("true")}},
+	})
+	if err != nil {
+		return fmt.Errorf("creating instance profile: %w", err)
+	}
+	_, err = p.iam.AddRoleToInstanceProfile(ctx, &iam.AddRoleToInstanceProfileInput{
+		InstanceProfileName: aws.String(name),
+		RoleName:            aws.String(name),
+	})
+	if err != nil {
+		return fmt.Errorf("adding role to instance profile: %w", err)
+	}
+	return nil
+}
+
+const ec2TrustPolicy = `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Principal":{"Service":"ec2.amazonaws.com"},"Action":"sts:AssumeRole"}]}`
+
+// authKeyPolicy returns a policy allowing only reading and deleting the
+// given parameter.
+func authKeyPolicy(region, param string) (string, error) {
+	doc := map[string]any{
+		"Version": "2012-10-17",
+		"Statement": []map[string]any{{
+			"Effect":   "Allow",
+			"Action":   []string{"ssm:GetParameter", "ssm:DeleteParameter"},
+			"Resource": fmt.Sprintf("arn:aws:ssm:%s:*:parameter%s", region, param),
+		}},
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return "", fmt.Errorf("encoding auth key policy: %w", err)
+	}
+	return string(b), nil
+}
+
+// deleteAuthKey deletes the auth key parameter, which the node normally
+// deletes itself once it has read it.
+func (p *Provider) deleteAuthKey(ctx context.Context, param string) error {
+	_, err := p.ssm.DeleteParameter(ctx, &ssm.DeleteParameterInput{Name: aws.String(param)})
+	var notFound *ssmtypes.ParameterNotFound
+	if err != nil && !errors.As(err, &notFound) {
+		return fmt.Errorf("deleting auth key: %w", err)
+	}
+	return nil
+}
+
+// deleteInstanceProfile deletes the instance profile and its role. Each
+// step tolerates what an earlier, partial provision or teardown left out.
+func (p *Provider) deleteInstanceProfile(ctx context.Context, name string) error {
+	steps := []struct {
+		what string
+		run  func() error
+	}{
+		{"removing role from instance profile", func() error {
+			_, err := p.iam.RemoveRoleFromInstanceProfile(ctx, &iam.RemoveRoleFromInstanceProfileInput{
+				InstanceProfileName: aws.String(name),
+				RoleName:            aws.String(name),
+			})
+			return err
+		}},
+		{"deleting instance profile", func() error {
+			_, err := p.iam.DeleteInstanceProfile(ctx, &iam.DeleteInstanceProfileInput{InstanceProfileName: aws.String(name)})
+			return err
+		}},
+		{"deleting role policy", func() error {
+			_, err := p.iam.DeleteRolePolicy(ctx, &iam.DeleteRolePolicyInput{RoleName: aws.String(name), PolicyName: aws.String("auth-key")})
+			return err
+		}},
+		{"deleting instance role", func() error {
+			_, err := p.iam.DeleteRole(ctx, &iam.DeleteRoleInput{RoleName: aws.String(name)})
+			return err
+		}},
+	}
+	for _, step := range steps {
+		var notFound *iamtypes.NoSuchEntityException
+		if err := step.run(); err != nil && !errors.As(err, &notFound) {
+			return fmt.Errorf("%s: %w", step.what, err)
+		}
+	}
+	return nil
+}
+
+// isProfilePropagating reports whether RunInstances failed because EC2 can't
+// see a newly created instance profile yet.
+func isProfilePropagating(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidParameterValue" &&
+		strings.Contains(apiErr.ErrorMessage(), "iamInstanceProfile")
+}
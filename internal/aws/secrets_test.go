@@ -0,0 +1,117 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestAuthKeyPolicy(t *testing.T) {
+	doc, err := authKeyPolicy("us-west-2", "/mayfly/mayfly-us-west-2-abc123/auth-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var policy struct {
+		Statement []struct {
+			Effect   string
+			Action   []string
+			Resource string
+		}
+	}
+	if err := json.Unmarshal([]byte(doc), &policy); err != nil {
+		t.Fatalf("policy is not JSON: %v", err)
+	}
+	if len(policy.Statement) != 1 {
+		t.Fatalf("got %d statements, want 1", len(policy.Statement))
+	}
+	st := policy.Statement[0]
+	if want := []string{"ssm:GetParameter", "ssm:DeleteParameter"}; st.Effect != "Allow" || !reflect.DeepEqual(st.Action, want) {
+		t.Errorf("statement = %+v, want Allow %v", st, want)
+	}
+	if want := "arn:aws:ssm:us-west-2:*:parameter/mayfly/mayfly-us-west-2-abc123/auth-key"; st.Resource != want {
+		t.Errorf("Resource = %q, want %q", st.Resource, want)
+	}
+}
+
+func TestIsProfilePropagating(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&smithy.GenericAPIError{Code: "InvalidParameterValue", Message: "Value (mayfly-x) for parameter iamInstanceProfile.name is invalid. Invalid IAM Instance Profile name"}, true},
+		{fmt.Errorf("operation error: %w", &smithy.GenericAPIError{Code: "InvalidParameterValue", Message: "iamInstanceProfile"}), true},
+		{&smithy.GenericAPIError{Code: "InvalidParameterValue", Message: "Invalid user data"}, false},
+		{&smithy.GenericAPIError{Code: "UnauthorizedOperation"}, false},
+		{errors.New("connection refused"), false},
+	}
+	for _, tt := range tests {
+		if got := isProfilePropagating(tt.err); got != tt.want {
+			t.Errorf("isProfilePropagating(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestDeleteInstanceProfile(t *testing.T) {
+	var actions []string
+	p := stubEC2(t, func(action string, form url.Values) string {
+		actions = append(actions, action)
+		return fmt.Sprintf("<%sResponse><ResponseMetadata><RequestId>r</RequestId></ResponseMetadata></%[1]sResponse>", action)
+	})
+
+	if err := p.deleteInstanceProfile(context.Background(), "mayfly-us-west-2-abc123"); err != nil {
+		t.Fatal(err)
+	}
+	// The role has to leave the profile, and lose its inline policy, before
+	// either can be deleted.
+	want := []string{"RemoveRoleFromInstanceProfile", "DeleteInstanceProfile", "DeleteRolePolicy", "DeleteRole"}
+	if !reflect.DeepEqual(actions, want) {
+		t.Errorf("actions = %v, want %v", actions, want)
+	}
+}
+
+func TestListInstanceProfiles(t *testing.T) {
+	var prefixes []string
+	p := stubEC2(t, func(action string, form url.Values) string {
+		prefixes = append(prefixes, form.Get("PathPrefix"))
+		switch action {
+		case "ListInstanceProfiles":
+			return `<ListInstanceProfilesResponse><ListInstanceProfilesResult><IsTruncated>false</IsTruncated><InstanceProfiles>
+				<member><InstanceProfileName>mayfly-us-west-2-abc123</InstanceProfileName><InstanceProfileId>p1</InstanceProfileId><Path>/mayfly/</Path><Arn>arn</Arn><CreateDate>2026-10-16T10:00:05Z</CreateDate><Roles/></member>
+			</InstanceProfiles></ListInstanceProfilesResult></ListInstanceProfilesResponse>`
+		case "ListRoles":
+			return `<ListRolesResponse><ListRolesResult><IsTruncated>false</IsTruncated><Roles>
+				<member><RoleName>mayfly-us-west-2-abc123</RoleName><RoleId>r1</RoleId><Path>/mayfly/</Path><Arn>arn</Arn><CreateDate>2026-10-16T10:00:00Z</CreateDate></member>
+				<member><RoleName>mayfly-eu-west-1-def456</RoleName><RoleId>r2</RoleId><Path>/mayfly/</Path><Arn>arn</Arn><CreateDate>2026-10-15T09:00:00Z</CreateDate></member>
+			</Roles></ListRolesResult></ListRolesResponse>`
+		}
+		t.Errorf("unexpected action %s", action)
+		return ""
+	})
+
+	profiles, err := p.ListInstanceProfiles(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A role left without its profile is listed too, and each name once,
+	// created when the first of the two was.
+	want := []NodeProfile{
+		{Name: "mayfly-eu-west-1-def456", Created: time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC)},
+		{Name: "mayfly-us-west-2-abc123", Created: time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC)},
+	}
+	if !reflect.DeepEqual(profiles, want) {
+		t.Errorf("profiles = %+v, want %+v", profiles, want)
+	}
+	for _, prefix := range prefixes {
+		if prefix != iamPath {
+			t.Errorf("listed under %q, want only %s", prefix, iamPath)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// TaggedInstance is a live instance carrying the mayfly=true tag.
+type TaggedInstance struct {
+	ID               string
+	Name             string
+	State            string
+	Deadline         time.Time // zero if the deadline tag is missing or malformed
+	LaunchTime       time.Time
+	SecurityGroupIDs []string
+}
+
+// TaggedSecurityGroup is a security group carrying the mayfly=true tag.
+type TaggedSecurityGroup struct {
+	ID      string
+	Name    string
+	Created time.Time // zero if the created tag is missing or malformed
+}
+
+// TaggedParameter is an auth key parameter carrying the mayfly=true tag.
+type TaggedParameter struct {
+	Name     string
+	Node     string // the node whose auth key it holds, "" if the name doesn't say
+	Modified time.Time
+}
+
+// NodeProfile is an instance profile and role created for a node under
+// iamPath, both named after the node. Either may be missing if a provision
+// or teardown stopped partway.
+type NodeProfile struct {
+	Name    string
+	Created time.Time // the earlier of the two
+}
+
+var mayflyTagFilter = types.Filter{Name: aws.String("tag:mayfly"), Values: []string{"true"}}
+
+// EnabledRegions returns every region enabled for the account.
+func (p *Provider) EnabledRegions(ctx context.Context) ([]string, error) {
+	out, err := p.ec2.DescribeRegions(ctx, &ec2.DescribeRegionsInput{})
+	if err != nil {
+		return nil, fmt.Errorf("describing regions: %w", err)
+	}
+
+	regions := make([]string, 0, len(out.Regions))
+	for _, r := range out.Regions {
+		regions = append(regions, aws.ToString(r.RegionName))
+	}
+	return regions, nil
+}
+
+// ListTagged returns the non-terminated instances and the security groups in
+// the provider's region that carry the mayfly=true tag.
+func (p *Provider) ListTagged(ctx context.Context) ([]TaggedInstance, []TaggedSecurityGroup, error) {
+	var instances []TaggedInstance
+	ip := ec2.NewDescribeInstancesPaginator(p.ec2, &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			mayflyTagFilter,
+			{Name: aws.String("instance-state-name"), Values: []string{"pending", "running", "stopping", "stopped"}},
+		},
+	})
+	for ip.HasMorePages() {
+		page, err := ip.NextPage(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("describing instances: %w", err)
+		}
+		for _, r := range page.Reservations {
+			for _, inst := range r.Instances {
+				ti := TaggedInstance{ID: aws.ToString(inst.InstanceId), LaunchTime: aws.ToTime(inst.LaunchTime)}
+				if inst.State != nil {
+					ti.State = string(inst.State.Name)
+				}
+				for _, t := range inst.Tags {
+					switch aws.ToString(t.Key) {
+					case "Name":
+						ti.Name = aws.ToString(t.Value)
+					case DeadlineTag:
+						ti.Deadline, _ = time.Parse(time.RFC3339, aws.ToString(t.Value))
+					}
+				}
+				for _, sg := range inst.SecurityGroups {
+					ti.SecurityGroupIDs = append(ti.SecurityGroupIDs, aws.ToString(sg.GroupId))
+				}
+				instances = append(instances, ti)
+			}
+		}
+	}
+
+	var groups []TaggedSecurityGroup
+	gp := ec2.NewDescribeSecurityGroupsPaginator(p.ec2, &ec2.DescribeSecurityGroupsInput{
+		Filters: []types.Filter{mayflyTagFilter},
+	})
+	for gp.HasMorePages() {
+		page, err := gp.NextPage(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("describing security groups: %w", err)
+		}
+		for _, sg := range page.SecurityGroups {
+			tg := TaggedSecurityGroup{
+				ID:   aws.ToString(sg.GroupId),
+				Name: aws.ToString(sg.GroupName),
+			}
+			for _, t := range sg.Tags {
+				if aws.ToString(t.Key) == CreatedTag {
+					tg.Created, _ = time.Parse(time.RFC3339, aws.ToString(t.Value))
+				}
+			}
+			groups = append(groups, tg)
+		}
+	}
+
+	return instances, groups, nil
+}
+
+// ListAuthKeyParameters returns the parameters in the provider's region that
+// carry the mayfly=true tag. A node deletes its own once it has read it, so
+// any left over belong to nodes that never got that far.
+func (p *Provider) ListAuthKeyParameters(ctx context.Context) ([]TaggedParameter, error) {
+	var params []TaggedParameter
+	pp := ssm.NewDescribeParametersPaginator(p.ssm, &ssm.DescribeParametersInput{
+		ParameterFilters: []ssmtypes.ParameterStringFilter{{Key: aws.String("tag:mayfly"), Values: []string{"true"}}},
+	})
+	for pp.HasMorePages() {
+		page, err := pp.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("describing parameters: %w", err)
+		}
+		for _, param := range page.Parameters {
+			tp := TaggedParameter{Name: aws.ToString(param.Name), Modified: aws.ToTime(param.LastModifiedDate)}
+			if node, ok := strings.CutPrefix(tp.Name, "/mayfly/"); ok {
+				if node, ok := strings.CutSuffix(node, "/auth-key"); ok && !strings.Contains(node, "/") {
+					tp.Node = node
+				}
+			}
+			params = append(params, tp)
+		}
+	}
+	return params, nil
+}
+
+// ListInstanceProfiles returns the instance profiles and roles under
+// iamPath, which are global rather than regional.
+func (p *Provider) ListInstanceProfiles(ctx context.Context) ([]NodeProfile, error) {
+	created := map[string]time.Time{}
+	seen := func(name string, t time.Time) {
+		if prev, ok := created[name]; !ok || t.Before(prev) {
+			created[name] = t
+		}
+	}
+
+	pp := iam.NewListInstanceProfilesPaginator(p.iam, &iam.ListInstanceProfilesInput{PathPrefix: aws.String(iamPath)})
+	for pp.HasMorePages() {
+		page, err := pp.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("listing instance profiles: %w", err)
+		}
+		for _, ip := range page.InstanceProfiles {
+			seen(aws.ToString(ip.InstanceProfileName), aws.ToTime(ip.CreateDate))
+		}
+	}
+	rp := iam.NewListRolesPaginator(p.iam, &iam.ListRolesInput{PathPrefix: aws.String(iamPath)})
+	for rp.HasMorePages() {
+		page, err := rp.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("listing roles: %w", err)
+		}
+		for _, r := range page.Roles {
+			seen(aws.ToString(r.RoleName), aws.ToTime(r.CreateDate))
+		}
+	}
+
+	profiles := make([]NodeProfile, 0, len(created))
+	for name, t := range created {
+		profiles = append(profiles, NodeProfile{Name: name, Created: t})
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	return profiles, nil
+}
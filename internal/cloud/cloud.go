@@ -0,0 +1,106 @@
+// Package cloud defines what Mayfly needs from a compute provider to launch
+// and destroy exit nodes, so the orchestrator doesn't depend on any one cloud.
+package cloud
+
+import (
+	"context"
+	"time"
+)
+
+// Resources tracks everything we create so teardown knows what to clean up.
+type Resources struct {
+	InstanceID      string
+	SecurityGroupID string
+	PublicIP        string
+	Spot            bool // the instance runs on spot capacity
+
+	// Set by providers that deliver the auth key out of band (SecretStore):
+	// where the key is stored, and the instance profile allowed to read it.
+	AuthKeyParameter string
+	InstanceProfile  string
+}
+
+// Spec describes the instance to launch.
+type Spec struct {
+	Name         string // node name, used for the instance and its security group
+	ImageID      string
+	InstanceType string
+	UserData     string // base64-encoded
+	Deadline     time.Time
+
+	// Spot requests interruptible spot capacity, falling back to on-demand
+	// when there is none. SpotMaxPrice caps the hourly price (default: the
+	// on-demand price).
+	Spot         bool
+	SpotMaxPrice string
+
+	// AuthKey is stored out of band by providers implementing SecretStore,
+	// and ignored by the rest, whose user-data carries it instead.
+	AuthKey string
+}
+
+// Instance describes the live state of a provisioned instance.
+type Instance struct {
+	State      string
+	PublicIP   string
+	LaunchTime time.Time
+	// Gone is set once the instance has stopped or is on its way out, e.g.
+	// after a spot interruption or its own self-destruct.
+	Gone bool
+}
+
+// Provider launches and destroys exit node instances in one region.
+type Provider interface {
+	// LookupImage returns the ID of the image to launch on the given
+	// instance type, built for its CPU architecture. image names an
+	// operating system (e.g. "ubuntu-24.04") or a provider-specific image ID.
+	LookupImage(ctx context.Context, image, instanceType string) (string, error)
+
+	// MaxUserData returns the most user-data, before base64 encoding, the
+	// provider accepts in a Spec.
+	MaxUserData() int
+
+	// Provision creates a security group and launches an instance, along
+	// with anything needed to hand it its auth key out of band. If it
+	// fails partway, it still returns whatever Resources were created so the
+	// caller can pass them to Teardown.
+	Provision(ctx context.Context, spec Spec) (*Resources, error)
+
+	// Describe returns the live state of an instance.
+	Describe(ctx context.Context, instanceID string) (*Instance, error)
+
+	// SetDeadline records a new deadline where the instance's self-destruct
+	// timer will see it.
+	SetDeadline(ctx context.Context, instanceID string, deadline time.Time) error
+
+	// Teardown terminates the instance and then deletes the security group
+	// and any auth key store and instance profile. Empty fields in res are
+	// skipped.
+	Teardown(ctx context.Context, res *Resources) error
+}
+
+// InstanceTypeChooser is implemented by providers whose default instance type
+// depends on what the region offers.
+type InstanceTypeChooser interface {
+	// DefaultInstanceType returns the cheapest suitable instance type
+	// offered in the provider's region.
+	DefaultInstanceType(ctx context.Context) (string, error)
+}
+
+// ConsoleReader is implemented by providers that can read back an
+// instance's serial console, where the bootstrap script reports progress.
+type ConsoleReader interface {
+	// ConsoleOutput returns the instance's most recent console output.
+	ConsoleOutput(ctx context.Context, instanceID string) (string, error)
+}
+
+// SecretStore is implemented by providers that can hand a node its auth key
+// out of band. User-data stays readable to anyone who can describe the
+// instance for as long as it runs, so the key is kept out of it: Provision
+// stores Spec.AuthKey where only the instance can read it, the node fetches
+// it once at boot, and Teardown deletes whatever is left.
+type SecretStore interface {
+	// AuthKeyParameter returns where the named node's bootstrap script
+	// fetches its auth key from.
+	AuthKeyParameter(name string) string
+}
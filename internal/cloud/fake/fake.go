@@ -0,0 +1,274 @@
+// Package fake provides an in-memory cloud.Provider with injectable
+// failures, for testing code that provisions and tears down nodes.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jamesboyd/mayfly/internal/cloud"
+)
+
+// Provider is an in-memory cloud.Provider. The zero value is not usable;
+// call New.
+type Provider struct {
+	// Errors to inject. ProvisionErr is returned after the security group
+	// has been created, so callers see partially populated Resources.
+	LookupImageErr error
+	ProvisionErr   error
+	DescribeErr    error
+	SetDeadlineErr error
+	TeardownErr    error
+
+	// OnProvision, if set, is called after an instance is launched, e.g. to
+	// have it join a fake tailnet.
+	OnProvision func(cloud.Spec, *cloud.Resources)
+
+	// Console is the console output every instance reports.
+	Console string
+
+	mu        sync.Mutex
+	nextID    int
+	instances map[string]*instance
+	groups    map[string]bool
+	secrets   map[string]string
+}
+
+type instance struct {
+	spec          cloud.Spec
+	securityGroup string
+	launchTime    time.Time
+	interrupted   bool
+}
+
+var (
+	_ cloud.Provider            = (*Provider)(nil)
+	_ cloud.InstanceTypeChooser = (*Provider)(nil)
+	_ cloud.ConsoleReader       = (*Provider)(nil)
+	_ cloud.SecretStore         = (*Provider)(nil)
+)
+
+// New returns an empty fake provider.
+func New() *Provider {
+	return &Provider{
+		instances: map[string]*instance{},
+		groups:    map[string]bool{},
+		secrets:   map[string]string{},
+	}
+}
+
+// DefaultInstanceTypeName is the instance type the fake offers by default.
+const DefaultInstanceTypeName = "fake.micro"
+
+// LookupImage returns a fixed image ID.
+func (p *Provider) LookupImage(ctx context.Context, image, instanceType string) (string, error) {
+	if p.LookupImageErr != nil {
+		return "", p.LookupImageErr
+	}
+	return "ami-fake", nil
+}
+
+// DefaultInstanceType returns DefaultInstanceTypeName.
+func (p *Provider) DefaultInstanceType(ctx context.Context) (string, error) {
+	return DefaultInstanceTypeName, nil
+}
+
+// AuthKeyParameter returns the name the fake stores a node's auth key under.
+func (p *Provider) AuthKeyParameter(name string) string {
+	return "/mayfly/" + name + "/auth-key"
+}
+
+// MaxUserData returns EC2's limit of 16 KiB.
+func (p *Provider) MaxUserData() int {
+	return 16 * 1024
+}
+
+// Provision records the auth key, if any, a security group and a running
+// instance.
+func (p *Provider) Provision(ctx context.Context, spec cloud.Spec) (*cloud.Resources, error) {
+	res, err := p.provision(spec)
+	if err == nil && p.OnProvision != nil {
+		p.OnProvision(spec, res)
+	}
+	return res, err
+}
+
+func (p *Provider) provision(spec cloud.Spec) (*cloud.Resources, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	res := &cloud.Resources{}
+
+	if spec.AuthKey != "" {
+		res.AuthKeyParameter = p.AuthKeyParameter(spec.Name)
+		res.InstanceProfile = spec.Name
+		p.secrets[res.AuthKeyParameter] = spec.AuthKey
+	}
+
+	p.nextID++
+	res.SecurityGroupID = fmt.Sprintf("sg-fake%d", p.nextID)
+	p.groups[res.SecurityGroupID] = true
+
+	if p.ProvisionErr != nil {
+		return res, p.ProvisionErr
+	}
+
+	res.InstanceID = fmt.Sprintf("i-fake%d", p.nextID)
+	res.PublicIP = fmt.Sprintf("192.0.2.%d", p.nextID)
+	res.Spot = spec.Spot
+	p.instances[res.InstanceID] = &instance{
+		spec:          spec,
+		securityGroup: res.SecurityGroupID,
+		launchTime:    time.Now(),
+	}
+	return res, nil
+}
+
+// Describe reports a recorded instance as running, or as terminated once
+// Interrupt has been called for it.
+func (p *Provider) Describe(ctx context.Context, instanceID string) (*cloud.Instance, error) {
+	if p.DescribeErr != nil {
+		return nil, p.DescribeErr
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	inst, ok := p.instances[instanceID]
+	if !ok {
+		return nil, fmt.Errorf("instance %s not found", instanceID)
+	}
+	if inst.interrupted {
+		return &cloud.Instance{State: "terminated", LaunchTime: inst.launchTime, Gone: true}, nil
+	}
+	return &cloud.Instance{State: "running", LaunchTime: inst.launchTime}, nil
+}
+
+// Interrupt simulates the cloud reclaiming an instance, as with a spot
+// interruption. The instance is reported as terminated but its security
+// group stays in place until Teardown.
+func (p *Provider) Interrupt(instanceID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if inst, ok := p.instances[instanceID]; ok {
+		inst.interrupted = true
+	}
+}
+
+// ConsoleOutput returns Console for a recorded instance.
+func (p *Provider) ConsoleOutput(ctx context.Context, instanceID string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.instances[instanceID]; !ok {
+		return "", fmt.Errorf("instance %s not found", instanceID)
+	}
+	return p.Console, nil
+}
+
+// SetDeadline updates a recorded instance's deadline.
+func (p *Provider) SetDeadline(ctx context.Context, instanceID string, deadline time.Time) error {
+	if p.SetDeadlineErr != nil {
+		return p.SetDeadlineErr
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	inst, ok := p.instances[instanceID]
+	if !ok {
+		return fmt.Errorf("instance %s not found", instanceID)
+	}
+	inst.spec.Deadline = deadline
+	return nil
+}
+
+// Teardown forgets the instance, security group and auth key. Like EC2, a
+// security group can't be deleted while an instance still uses it.
+func (p *Provider) Teardown(ctx context.Context, res *cloud.Resources) error {
+	if p.TeardownErr != nil {
+		return p.TeardownErr
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.instances, res.InstanceID)
+	delete(p.secrets, res.AuthKeyParameter)
+
+	if res.SecurityGroupID != "" {
+		for id, inst := range p.instances {
+			if inst.securityGroup == res.SecurityGroupID {
+				return fmt.Errorf("security group %s in use by %s", res.SecurityGroupID, id)
+			}
+		}
+		delete(p.groups, res.SecurityGroupID)
+	}
+	return nil
+}
+
+// Instances returns the IDs of instances that have not been torn down.
+func (p *Provider) Instances() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ids := make([]string, 0, len(p.instances))
+	for id := range p.instances {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// SecurityGroups returns the IDs of security groups that have not been deleted.
+func (p *Provider) SecurityGroups() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ids := make([]string, 0, len(p.groups))
+	for id := range p.groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Secret returns the auth key stored under parameter, if it has not been
+// deleted.
+func (p *Provider) Secret(parameter string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, ok := p.secrets[parameter]
+	return key, ok
+}
+
+// Secrets returns the names of auth keys that have not been deleted.
+func (p *Provider) Secrets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	names := make([]string, 0, len(p.secrets))
+	for name := range p.secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Spec returns the spec an instance was launched with, including any
+// deadline set since.
+func (p *Provider) Spec(instanceID string) (cloud.Spec, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	inst, ok := p.instances[instanceID]
+	if !ok {
+		return cloud.Spec{}, false
+	}
+	return inst.spec, true
+}
@@ -2,36 +2,236 @@ package config
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/jamesboyd/mayfly/internal/userdata"
+)
+
+// Cloud providers a node can run on.
+const (
+	ProviderAWS     = "aws"
+	ProviderHetzner = "hetzner"
+)
+
+// DefaultMaxLifetime caps a node's total lifetime, including extensions,
+// unless `up --max-lifetime` says otherwise.
+const DefaultMaxLifetime = 12 * time.Hour
+
+// Control servers a node can join.
+const (
+	ControlTailscale = "tailscale"
+	ControlHeadscale = "headscale"
 )
 
 type Config struct {
+	Provider         string
 	Region           string
 	TTL              time.Duration
 	InstanceType     string
+	Image            string
+	ImageOS          string
+	TailscaleVersion string
+	UserDataAppend   []string
+	Control          string
 	TailscaleAuthKey string
+	Tags             []string
+	CheckPolicy      bool
 	TailscaleAPIKey  string
 	TailscaleTailnet string
+	HeadscaleURL     string
+	HeadscaleAPIKey  string
+	HeadscaleUser    string
+	Detach           bool
+	MaxLifetime      time.Duration
+	HetznerToken     string
+	VPCID            string
+	SubnetID         string
+	SubnetTag        string
+	Spot             bool
+	SpotMaxPrice     string
+
+	TailscaleOAuthClientID     string
+	TailscaleOAuthClientSecret string
 }
 
 func (c *Config) Validate() error {
+	switch c.Provider {
+	case ProviderAWS, "":
+		if err := validateAWSRegion(c.Region); err != nil {
+			return err
+		}
+	case ProviderHetzner:
+		if c.HetznerToken == "" {
+			return fmt.Errorf("hcloud-token is required with the hetzner provider (flag or $HCLOUD_TOKEN)")
+		}
+		if c.VPCID != "" || c.SubnetID != "" || c.SubnetTag != "" {
+			return fmt.Errorf("vpc-id, subnet-id and subnet-tag only apply to the aws provider")
+		}
+		if c.Spot {
+			return fmt.Errorf("spot only applies to the aws provider")
+		}
+		// Hetzner servers get their auth key in user-data, which stays
+		// readable for the server's lifetime, so only a single-use key minted
+		// for the node may go there.
+		if c.TailscaleAuthKey != "" {
+			return fmt.Errorf("tailscale-auth-key can't be used with the hetzner provider, which would leave it readable in the server's user-data; let mayfly create a single-use key instead")
+		}
+		if strings.HasPrefix(c.Image, "ami-") || c.Image == userdata.AL2023 {
+			return fmt.Errorf("image %s is only available on the aws provider", c.Image)
+		}
+	default:
+		return fmt.Errorf("unknown provider %q (want %s or %s)", c.Provider, ProviderAWS, ProviderHetzner)
+	}
 	if c.Region == "" {
 		return fmt.Errorf("region is required")
 	}
 	if c.TTL <= 0 {
 		return fmt.Errorf("ttl must be positive")
 	}
-	if c.InstanceType == "" {
+	if c.MaxLifetime <= 0 {
+		return fmt.Errorf("max-lifetime must be positive")
+	}
+	if c.TTL > c.MaxLifetime {
+		return fmt.Errorf("ttl %s exceeds max-lifetime %s", c.TTL, c.MaxLifetime)
+	}
+	// On AWS an empty instance type picks the cheapest default the region offers.
+	if c.InstanceType == "" && c.Provider == ProviderHetzner {
 		return fmt.Errorf("instance-type is required")
 	}
-	if c.TailscaleAuthKey == "" {
-		return fmt.Errorf("tailscale-auth-key is required (flag or $TAILSCALE_AUTH_KEY)")
+	if err := c.validateImage(); err != nil {
+		return err
+	}
+	if err := userdata.ValidateTailscaleVersion(c.TailscaleVersion); err != nil {
+		return err
+	}
+	if c.SpotMaxPrice != "" {
+		if !c.Spot {
+			return fmt.Errorf("spot-max-price requires --spot")
+		}
+		if price, err := strconv.ParseFloat(c.SpotMaxPrice, 64); err != nil || price <= 0 {
+			return fmt.Errorf("spot-max-price %q must be a positive price in USD per hour", c.SpotMaxPrice)
+		}
+	}
+	for _, tag := range c.Tags {
+		if err := userdata.ValidateTag(tag); err != nil {
+			return err
+		}
+	}
+	// Auth keys created by an OAuth client must be tagged.
+	if c.TailscaleOAuthClientID != "" && c.TailscaleAuthKey == "" && len(c.Tags) == 0 {
+		return fmt.Errorf("tags are required to create auth keys with an OAuth client (flag or $MAYFLY_TAGS)")
+	}
+	return c.ValidateControl()
+}
+
+// ValidateControl checks only the control server settings needed to manage
+// an existing node, for commands that never launch one.
+func (c *Config) ValidateControl() error {
+	switch c.Control {
+	case ControlTailscale, "":
+		if err := c.validateTailscaleCredentials(); err != nil {
+			return err
+		}
+		if c.TailscaleTailnet == "" {
+			return fmt.Errorf("tailscale-tailnet is required (flag or $TAILSCALE_TAILNET)")
+		}
+	case ControlHeadscale:
+		if c.HeadscaleURL == "" {
+			return fmt.Errorf("headscale-url is required (flag or $HEADSCALE_URL)")
+		}
+		if err := userdata.ValidateLoginServer(c.HeadscaleURL); err != nil {
+			return err
+		}
+		if c.HeadscaleAPIKey == "" {
+			return fmt.Errorf("headscale-api-key is required (flag or $HEADSCALE_API_KEY)")
+		}
+		if c.HeadscaleUser == "" {
+			return fmt.Errorf("headscale-user is required (flag or $HEADSCALE_USER)")
+		}
+	default:
+		return fmt.Errorf("unknown control server %q (want %s or %s)", c.Control, ControlTailscale, ControlHeadscale)
+	}
+	return nil
+}
+
+// validateTailscaleCredentials requires exactly one of an API key or a
+// complete OAuth client.
+func (c *Config) validateTailscaleCredentials() error {
+	oauth := c.TailscaleOAuthClientID != "" || c.TailscaleOAuthClientSecret != ""
+	switch {
+	case c.TailscaleAPIKey != "" && oauth:
+		return fmt.Errorf("set either tailscale-api-key or an OAuth client, not both")
+	case oauth && c.TailscaleOAuthClientID == "":
+		return fmt.Errorf("tailscale-oauth-client-id is required with an OAuth client secret (flag or $TAILSCALE_OAUTH_CLIENT_ID)")
+	case oauth && c.TailscaleOAuthClientSecret == "":
+		return fmt.Errorf("tailscale-oauth-client-secret is required with an OAuth client ID (flag or $TAILSCALE_OAUTH_CLIENT_SECRET)")
+	case !oauth && c.TailscaleAPIKey == "":
+		return fmt.Errorf("tailscale-api-key or tailscale-oauth-client-id and -secret are required (flags or $TAILSCALE_API_KEY, $TAILSCALE_OAUTH_CLIENT_ID and $TAILSCALE_OAUTH_CLIENT_SECRET)")
+	}
+	return nil
+}
+
+// ValidateImageBuild checks the settings `mayfly image build` needs. Images
+// are built on AWS from one of the operating systems with a template.
+func (c *Config) ValidateImageBuild() error {
+	if c.Region == "" {
+		return fmt.Errorf("region is required")
+	}
+	if err := validateAWSRegion(c.Region); err != nil {
+		return err
 	}
-	if c.TailscaleAPIKey == "" {
-		return fmt.Errorf("tailscale-api-key is required (flag or $TAILSCALE_API_KEY)")
+	if !userdata.Supported(c.Image) {
+		return fmt.Errorf("images are built from one of %s, not %q", strings.Join(userdata.OSes(), ", "), c.Image)
+	}
+	return userdata.ValidateTailscaleVersion(c.TailscaleVersion)
+}
+
+// validateAWSRegion rejects GovCloud and China regions. Their ARNs and
+// endpoints live in other partitions than the standard one the node's auth
+// key fetch and its IAM policy are written for.
+func validateAWSRegion(region string) error {
+	if strings.HasPrefix(region, "us-gov-") || strings.HasPrefix(region, "cn-") {
+		return fmt.Errorf("region %s is outside the standard AWS partition, which is the only one mayfly supports", region)
 	}
-	if c.TailscaleTailnet == "" {
-		return fmt.Errorf("tailscale-tailnet is required (flag or $TAILSCALE_TAILNET)")
+	return nil
+}
+
+// validateImage requires a known operating system, or a custom AMI together
+// with the operating system it runs.
+func (c *Config) validateImage() error {
+	oses := strings.Join(userdata.OSes(), ", ")
+	switch {
+	case strings.HasPrefix(c.Image, "ami-"):
+		if c.ImageOS == "" {
+			return fmt.Errorf("image-os is required with a custom AMI, so the node gets the right bootstrap script (one of %s)", oses)
+		}
+		if !userdata.Supported(c.ImageOS) {
+			return fmt.Errorf("unknown image-os %q (want one of %s)", c.ImageOS, oses)
+		}
+	case !userdata.Supported(c.Image):
+		return fmt.Errorf("unknown image %q (want one of %s, or an AMI ID)", c.Image, oses)
+	case c.ImageOS != "":
+		return fmt.Errorf("image-os only applies to a custom AMI")
 	}
 	return nil
 }
+
+// OS returns the operating system the node's image runs, which selects its
+// bootstrap script.
+func (c *Config) OS() string {
+	if c.ImageOS != "" {
+		return c.ImageOS
+	}
+	return c.Image
+}
+
+// LoginServer returns the coordination server URL nodes should log in to,
+// or "" for the Tailscale default.
+func (c *Config) LoginServer() string {
+	if c.Control == ControlHeadscale {
+		return c.HeadscaleURL
+	}
+	return ""
+}
@@ -0,0 +1,108 @@
+// Package control defines what Mayfly needs from the tailnet control server,
+// so the orchestrator doesn't depend on any one control plane.
+package control
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Device is the subset of tailnet device details Mayfly works with.
+type Device struct {
+	ID       string
+	Hostname string
+	Created  time.Time
+	LastSeen time.Time
+}
+
+// Online reports whether the device has checked in with the control plane recently.
+func (d *Device) Online() bool {
+	return time.Since(d.LastSeen) < 2*time.Minute
+}
+
+// Plane is the set of device operations Mayfly performs on the control server.
+type Plane interface {
+	// ListDevices returns every device whose hostname starts with the given prefix.
+	ListDevices(ctx context.Context, hostnamePrefix string) ([]Device, error)
+
+	// ApproveExitNode enables exit node routes (0.0.0.0/0 and ::/0) for a device.
+	ApproveExitNode(ctx context.Context, deviceID string) error
+
+	// RemoveDevice deletes a device from the tailnet by ID.
+	RemoveDevice(ctx context.Context, deviceID string) error
+}
+
+// KeyRequest describes a pre-auth key for a single node.
+type KeyRequest struct {
+	// Expiry is how long the key stays usable. It only needs to cover boot.
+	Expiry time.Duration
+	// Tags are the ACL tags (e.g. "tag:exit") the node is registered with.
+	Tags []string
+}
+
+// AuthKeyCreator is implemented by control planes that can mint pre-auth
+// keys, so the user doesn't have to supply one.
+type AuthKeyCreator interface {
+	// CreateAuthKey returns a single-use key for an ephemeral node.
+	CreateAuthKey(ctx context.Context, req KeyRequest) (string, error)
+}
+
+// ErrAmbiguous is returned when more than one device could be the node.
+var ErrAmbiguous = errors.New("ambiguous device match")
+
+// Hostname returns the tailnet hostname of a node launched as the given
+// instance: the node name followed by the instance ID, which the node reads
+// at boot. It ties the device to that one launch.
+func Hostname(name, instanceID string) string {
+	return name + "-" + instanceID
+}
+
+// FindDevice returns the device registered under exactly the hostname of the
+// node launched as instanceID, so a device from another launch or a neighbour
+// with a similar name is never mistaken for it. Several matches are an
+// ErrAmbiguous error rather than a guess.
+func FindDevice(ctx context.Context, p Plane, name, instanceID string) (*Device, error) {
+	hostname := Hostname(name, instanceID)
+	devices, err := p.ListDevices(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []Device
+	for _, d := range devices {
+		if d.Hostname == hostname {
+			matches = append(matches, d)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("device with hostname %q not found", hostname)
+	case 1:
+		return &matches[0], nil
+	default:
+		ids := make([]string, len(matches))
+		for i, d := range matches {
+			ids[i] = d.ID
+		}
+		return nil, fmt.Errorf("%w: %d devices named %q (%s)", ErrAmbiguous, len(matches), hostname, strings.Join(ids, ", "))
+	}
+}
+
+// GetDevice returns the device with the given ID, which is registered under
+// the given hostname.
+func GetDevice(ctx context.Context, p Plane, hostname, id string) (*Device, error) {
+	devices, err := p.ListDevices(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range devices {
+		if d.ID == id {
+			return &d, nil
+		}
+	}
+	return nil, fmt.Errorf("device %s not found", id)
+}
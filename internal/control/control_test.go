@@ -0,0 +1,79 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type stubPlane []Device
+
+func (p stubPlane) ListDevices(ctx context.Context, hostnamePrefix string) ([]Device, error) {
+	return p, nil
+}
+
+func (p stubPlane) ApproveExitNode(ctx context.Context, deviceID string) error { return nil }
+
+func (p stubPlane) RemoveDevice(ctx context.Context, deviceID string) error { return nil }
+
+func TestFindDevice(t *testing.T) {
+	tests := []struct {
+		name    string
+		devices stubPlane
+		want    string
+		wantErr error
+	}{
+		{
+			name:    "exact hostname",
+			devices: stubPlane{{ID: "1", Hostname: "mayfly-a-i-1"}},
+			want:    "1",
+		},
+		{
+			name:    "prefix only",
+			devices: stubPlane{{ID: "1", Hostname: "mayfly-a-i-1-1"}},
+		},
+		{
+			name:    "name without instance ID",
+			devices: stubPlane{{ID: "1", Hostname: "mayfly-a"}},
+		},
+		{
+			name: "another launch",
+			devices: stubPlane{
+				{ID: "1", Hostname: "mayfly-a-i-0"},
+				{ID: "2", Hostname: "mayfly-a-i-1"},
+			},
+			want: "2",
+		},
+		{
+			name: "ambiguous",
+			devices: stubPlane{
+				{ID: "1", Hostname: "mayfly-a-i-1"},
+				{ID: "2", Hostname: "mayfly-a-i-1"},
+			},
+			wantErr: ErrAmbiguous,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev, err := FindDevice(context.Background(), tt.devices, "mayfly-a", "i-1")
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("FindDevice error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("FindDevice = %s, want not found", dev.ID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FindDevice: %v", err)
+			}
+			if dev.ID != tt.want {
+				t.Errorf("FindDevice = %s, want %s", dev.ID, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/tailscale/hujson"
+)
+
+// PolicyReader is implemented by control planes that can return the tailnet
+// policy file, so it can be checked before launch.
+type PolicyReader interface {
+	// Policy returns the tailnet policy file as HuJSON.
+	Policy(ctx context.Context) ([]byte, error)
+}
+
+// ExitNodeAutoApproved reports whether the policy's autoApprovers.exitNode
+// entry approves a node carrying any of the given tags. Only tag approvers can
+// be matched against a node's tags. The others (users, group: and autogroup:
+// entries) are returned as unchecked: whether they cover a tagged node
+// depends on who authenticated it, which isn't known before launch.
+func ExitNodeAutoApproved(policy []byte, tags []string) (approved bool, unchecked []string, err error) {
+	std, err := hujson.Standardize(policy)
+	if err != nil {
+		return false, nil, fmt.Errorf("parsing policy file: %w", err)
+	}
+
+	var p struct {
+		AutoApprovers struct {
+			ExitNode []string `json:"exitNode"`
+		} `json:"autoApprovers"`
+	}
+	if err := json.Unmarshal(std, &p); err != nil {
+		return false, nil, fmt.Errorf("parsing policy file: %w", err)
+	}
+
+	for _, tag := range tags {
+		if slices.Contains(p.AutoApprovers.ExitNode, tag) {
+			return true, nil, nil
+		}
+	}
+	for _, approver := range p.AutoApprovers.ExitNode {
+		if !strings.HasPrefix(approver, "tag:") {
+			unchecked = append(unchecked, approver)
+		}
+	}
+	return false, unchecked, nil
+}
@@ -0,0 +1,59 @@
+package control
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestExitNodeAutoApproved(t *testing.T) {
+	policy := []byte(`{
+		// Exit nodes tagged tag:exit approve themselves.
+		"tagOwners": {"tag:exit": ["autogroup:admin"]},
+		"autoApprovers": {
+			"exitNode": ["tag:exit"],
+		},
+	}`)
+
+	tests := []struct {
+		tags []string
+		want bool
+	}{
+		{[]string{"tag:exit"}, true},
+		{[]string{"tag:server", "tag:exit"}, true},
+		{[]string{"tag:server"}, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		got, _, err := ExitNodeAutoApproved(policy, tt.tags)
+		if err != nil {
+			t.Fatalf("ExitNodeAutoApproved(%v): %v", tt.tags, err)
+		}
+		if got != tt.want {
+			t.Errorf("ExitNodeAutoApproved(%v) = %v, want %v", tt.tags, got, tt.want)
+		}
+	}
+
+	if _, _, err := ExitNodeAutoApproved([]byte(`{"autoApprovers": `), []string{"tag:exit"}); err == nil {
+		t.Error("ExitNodeAutoApproved accepted a truncated policy")
+	}
+}
+
+func TestExitNodeAutoApprovedReportsUncheckedApprovers(t *testing.T) {
+	policy := []byte(`{
+		"autoApprovers": {
+			"exitNode": ["tag:router", "group:netops", "autogroup:admin", "alice@example.com"],
+		},
+	}`)
+
+	approved, unchecked, err := ExitNodeAutoApproved(policy, []string{"tag:exit"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if approved {
+		t.Error("approved by approvers that don't list the node's tag")
+	}
+	want := []string{"group:netops", "autogroup:admin", "alice@example.com"}
+	if !slices.Equal(unchecked, want) {
+		t.Errorf("unchecked = %v, want %v", unchecked, want)
+	}
+}
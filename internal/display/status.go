@@ -1,7 +1,10 @@
 package display
 
 import (
+	"bufio"
 	"fmt"
+	"os"
+	"strings"
 	"time"
 )
 
@@ -34,9 +37,21 @@ func Info(label, value string) {
 	fmt.Printf("  %s%-18s%s %s\n", colorCyan, label, colorReset, value)
 }
 
+// Confirm asks a yes/no question on stdin. Anything but "y" or "yes" is a no.
+func Confirm(question string) bool {
+	fmt.Printf("%s%s?%s %s [y/N] ", colorBold, colorYellow, colorReset, question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
 // Countdown displays a live in-place countdown timer.
 // It returns when the deadline is reached or the done channel is closed.
-func Countdown(deadline time.Time, done <-chan struct{}) {
+// A deadline received on extend replaces the current one.
+func Countdown(deadline time.Time, extend <-chan time.Time, done <-chan struct{}) {
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
 
@@ -53,6 +68,9 @@ func Countdown(deadline time.Time, done <-chan struct{}) {
 		case <-done:
 			fmt.Println()
 			return
+		case d := <-extend:
+			deadline = d
+			fmt.Printf("\r%s%s✓%s TTL extended until %s          \n", colorBold, colorGreen, colorReset, d.Format(time.Kitchen))
 		case <-ticker.C:
 		}
 	}
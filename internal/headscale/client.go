@@ -0,0 +1,191 @@
+// Package headscale implements control.Plane against the Headscale REST API
+// (/api/v1, as served by Headscale 0.26 and later).
+package headscale
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jamesboyd/mayfly/internal/control"
+)
+
+// Client talks to a Headscale server with an API key.
+type Client struct {
+	serverURL string
+	apiKey    string
+	user      string
+	http      *http.Client
+}
+
+var (
+	_ control.Plane          = (*Client)(nil)
+	_ control.AuthKeyCreator = (*Client)(nil)
+	_ control.PolicyReader   = (*Client)(nil)
+)
+
+// NewClient creates a Headscale API client. Nodes are listed and pre-auth
+// keys are created for the given Headscale user.
+func NewClient(serverURL, apiKey, user string) *Client {
+	return &Client{
+		serverURL: strings.TrimRight(serverURL, "/"),
+		apiKey:    apiKey,
+		user:      user,
+		http:      &http.Client{Timeout: time.Minute},
+	}
+}
+
+type node struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Online    bool      `json:"online"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ListDevices returns every node of the user whose hostname starts with the given prefix.
+func (c *Client) ListDevices(ctx context.Context, hostnamePrefix string) ([]control.Device, error) {
+	var resp struct {
+		Nodes []node `json:"nodes"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/v1/node?user="+url.QueryEscape(c.user), nil, &resp); err != nil {
+		return nil, fmt.Errorf("listing nodes: %w", err)
+	}
+
+	var matches []control.Device
+	for _, n := range resp.Nodes {
+		if !strings.HasPrefix(n.Name, hostnamePrefix) {
+			continue
+		}
+		// Headscale only updates lastSeen when a node disconnects, so a
+		// connected node is seen now.
+		lastSeen := n.LastSeen
+		if n.Online {
+			lastSeen = time.Now()
+		}
+		matches = append(matches, control.Device{ID: n.ID, Hostname: n.Name, Created: n.CreatedAt, LastSeen: lastSeen})
+	}
+	return matches, nil
+}
+
+// ApproveExitNode approves exit node routes (0.0.0.0/0 and ::/0) for a node.
+func (c *Client) ApproveExitNode(ctx context.Context, deviceID string) error {
+	body := map[string][]string{"routes": {"0.0.0.0/0", "::/0"}}
+	if err := c.do(ctx, http.MethodPost, "/api/v1/node/"+url.PathEscape(deviceID)+"/approve_routes", body, nil); err != nil {
+		return fmt.Errorf("approving exit node routes: %w", err)
+	}
+	return nil
+}
+
+// RemoveDevice deletes a node from Headscale by ID.
+func (c *Client) RemoveDevice(ctx context.Context, deviceID string) error {
+	if err := c.do(ctx, http.MethodDelete, "/api/v1/node/"+url.PathEscape(deviceID), nil, nil); err != nil {
+		return fmt.Errorf("removing node: %w", err)
+	}
+	return nil
+}
+
+// CreateAuthKey creates a single-use, ephemeral pre-auth key for the user.
+func (c *Client) CreateAuthKey(ctx context.Context, req control.KeyRequest) (string, error) {
+	userID, err := c.userID(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	body := map[string]any{
+		"user":       userID,
+		"reusable":   false,
+		"ephemeral":  true,
+		"expiration": time.Now().Add(req.Expiry).UTC().Format(time.RFC3339),
+		"aclTags":    req.Tags,
+	}
+	var resp struct {
+		PreAuthKey struct {
+			Key string `json:"key"`
+		} `json:"preAuthKey"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/api/v1/preauthkey", body, &resp); err != nil {
+		return "", fmt.Errorf("creating pre-auth key: %w", err)
+	}
+	return resp.PreAuthKey.Key, nil
+}
+
+// Policy returns the policy stored in the database. Headscale must be run
+// with policy.mode set to "database" for it to be served.
+func (c *Client) Policy(ctx context.Context) ([]byte, error) {
+	var resp struct {
+		Policy string `json:"policy"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/v1/policy", nil, &resp); err != nil {
+		return nil, fmt.Errorf("reading policy: %w", err)
+	}
+	return []byte(resp.Policy), nil
+}
+
+// userID resolves the configured user name to the numeric ID the pre-auth
+// key API expects.
+func (c *Client) userID(ctx context.Context) (string, error) {
+	var resp struct {
+		Users []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"users"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/v1/user?name="+url.QueryEscape(c.user), nil, &resp); err != nil {
+		return "", fmt.Errorf("looking up user %s: %w", c.user, err)
+	}
+	for _, u := range resp.Users {
+		if u.Name == c.user {
+			return u.ID, nil
+		}
+	}
+	return "", fmt.Errorf("headscale user %q not found", c.user)
+}
+
+// do sends a JSON request and decodes the JSON response into out, if non-nil.
+func (c *Client) do(ctx context.Context, method, path string, body, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.serverURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Message != "" {
+			return fmt.Errorf("headscale API %s: %s", resp.Status, apiErr.Message)
+		}
+		return fmt.Errorf("headscale API %s", resp.Status)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
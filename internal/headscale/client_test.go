@@ -0,0 +1,118 @@
+package headscale
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jamesboyd/mayfly/internal/control"
+)
+
+// newTestServer serves a minimal Headscale API with one user, "ops", who
+// owns an online mayfly node, an offline mayfly node and a laptop.
+func newTestServer(t *testing.T) (*Client, *http.ServeMux) {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer hs-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]any{"code": 16, "message": "Unauthorized"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	mux.HandleFunc("GET /api/v1/node", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("user") != "ops" {
+			t.Errorf("listed nodes for user %q, want ops", r.URL.Query().Get("user"))
+		}
+		old := time.Now().Add(-time.Hour).Format(time.RFC3339)
+		json.NewEncoder(w).Encode(map[string]any{"nodes": []map[string]any{
+			{"id": "1", "name": "mayfly-us-west-2-aaaaaa", "lastSeen": old, "online": true},
+			{"id": "2", "name": "mayfly-us-west-2-bbbbbb", "lastSeen": old, "online": false},
+			{"id": "3", "name": "laptop", "lastSeen": old, "online": true},
+		}})
+	})
+	mux.HandleFunc("GET /api/v1/user", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"users": []map[string]any{
+			{"id": "7", "name": r.URL.Query().Get("name")},
+		}})
+	})
+
+	return NewClient(srv.URL+"/", "hs-key", "ops"), mux
+}
+
+func TestListDevices(t *testing.T) {
+	c, _ := newTestServer(t)
+
+	devices, err := c.ListDevices(context.Background(), "mayfly-")
+	if err != nil {
+		t.Fatalf("ListDevices: %v", err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("ListDevices = %+v, want the two mayfly nodes", devices)
+	}
+	if !devices[0].Online() {
+		t.Error("connected node reported offline")
+	}
+	if devices[1].Online() {
+		t.Error("disconnected node reported online")
+	}
+}
+
+func TestApproveExitNode(t *testing.T) {
+	c, mux := newTestServer(t)
+
+	var got []string
+	mux.HandleFunc("POST /api/v1/node/{id}/approve_routes", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Routes []string `json:"routes"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		got = body.Routes
+		json.NewEncoder(w).Encode(map[string]any{"node": map[string]any{"id": r.PathValue("id")}})
+	})
+
+	if err := c.ApproveExitNode(context.Background(), "1"); err != nil {
+		t.Fatalf("ApproveExitNode: %v", err)
+	}
+	if len(got) != 2 || got[0] != "0.0.0.0/0" || got[1] != "::/0" {
+		t.Errorf("approved routes = %v, want [0.0.0.0/0 ::/0]", got)
+	}
+}
+
+func TestCreateAuthKey(t *testing.T) {
+	c, mux := newTestServer(t)
+
+	var got map[string]any
+	mux.HandleFunc("POST /api/v1/preauthkey", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		json.NewEncoder(w).Encode(map[string]any{"preAuthKey": map[string]any{"key": "hskey-auth-1"}})
+	})
+
+	key, err := c.CreateAuthKey(context.Background(), control.KeyRequest{Expiry: 10 * time.Minute})
+	if err != nil {
+		t.Fatalf("CreateAuthKey: %v", err)
+	}
+	if key != "hskey-auth-1" {
+		t.Errorf("key = %q, want hskey-auth-1", key)
+	}
+	if got["user"] != "7" || got["reusable"] != false || got["ephemeral"] != true {
+		t.Errorf("request = %v, want a single-use ephemeral key for user 7", got)
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	c, _ := newTestServer(t)
+	c.apiKey = "wrong"
+
+	_, err := c.ListDevices(context.Background(), "mayfly-")
+	if err == nil || err.Error() != "listing nodes: headscale API 401 Unauthorized: Unauthorized" {
+		t.Errorf("ListDevices error = %v, want the API's message", err)
+	}
+}
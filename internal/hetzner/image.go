@@ -0,0 +1,58 @@
+package hetzner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// systemImages are the images nodes can run. Hetzner names its system images
+// the same way mayfly names the operating systems it has templates for.
+var systemImages = []string{"ubuntu-24.04", "debian-12"}
+
+// LookupImage returns the ID of the named system image for the server type's
+// architecture, so ARM (cax) types work too.
+func (p *Provider) LookupImage(ctx context.Context, image, serverType string) (string, error) {
+	if !slices.Contains(systemImages, image) {
+		return "", fmt.Errorf("image %q is not available on Hetzner (want one of %s)", image, strings.Join(systemImages, ", "))
+	}
+
+	arch, err := p.architecture(ctx, serverType)
+	if err != nil {
+		return "", err
+	}
+
+	var resp struct {
+		Images []struct {
+			ID int64 `json:"id"`
+		} `json:"images"`
+	}
+	path := "/images?type=system&architecture=" + arch + "&name=" + image
+	if err := p.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return "", fmt.Errorf("looking up image: %w", err)
+	}
+	if len(resp.Images) == 0 {
+		return "", fmt.Errorf("image %s (%s) not found", image, arch)
+	}
+	return strconv.FormatInt(resp.Images[0].ID, 10), nil
+}
+
+// architecture returns the CPU architecture of a server type: "x86" or "arm".
+func (p *Provider) architecture(ctx context.Context, serverType string) (string, error) {
+	var resp struct {
+		ServerTypes []struct {
+			Architecture string `json:"architecture"`
+		} `json:"server_types"`
+	}
+	if err := p.do(ctx, http.MethodGet, "/server_types?name="+url.QueryEscape(serverType), nil, &resp); err != nil {
+		return "", fmt.Errorf("looking up server type %s: %w", serverType, err)
+	}
+	if len(resp.ServerTypes) == 0 {
+		return "", fmt.Errorf("server type %s not found", serverType)
+	}
+	return resp.ServerTypes[0].Architecture, nil
+}
@@ -0,0 +1,119 @@
+// Package hetzner implements cloud.Provider on Hetzner Cloud, talking to its
+// REST API directly.
+package hetzner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jamesboyd/mayfly/internal/cloud"
+)
+
+const defaultBaseURL = "https://api.hetzner.cloud/v1"
+
+// Provider is the Hetzner Cloud implementation of cloud.Provider for one
+// location (e.g. fsn1, ash).
+type Provider struct {
+	token    string
+	location string
+	baseURL  string
+	http     *http.Client
+
+	// How often to poll while waiting for a server to start or go away.
+	pollInterval time.Duration
+}
+
+var _ cloud.Provider = (*Provider)(nil)
+
+// Option configures a Provider.
+type Option func(*Provider)
+
+// WithBaseURL points the provider at a different API server, such as a test fake.
+func WithBaseURL(u string) Option {
+	return func(p *Provider) {
+		p.baseURL = strings.TrimRight(u, "/")
+	}
+}
+
+// New returns a Provider for the location, authenticating with an API token.
+func New(token, location string, opts ...Option) (*Provider, error) {
+	if token == "" {
+		return nil, fmt.Errorf("a Hetzner Cloud API token is required (flag or $HCLOUD_TOKEN)")
+	}
+	p := &Provider{
+		token:        token,
+		location:     location,
+		baseURL:      defaultBaseURL,
+		http:         &http.Client{Timeout: time.Minute},
+		pollInterval: 2 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p, nil
+}
+
+// apiError is an error response from the Hetzner Cloud API.
+type apiError struct {
+	Status  int
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("hetzner API %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// isNotFound reports whether err is the API's not_found error.
+func isNotFound(err error) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) && apiErr.Code == "not_found"
+}
+
+// do sends a JSON request and decodes the JSON response into out, if non-nil.
+func (p *Provider) do(ctx context.Context, method, path string, body, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.baseURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var errResp struct {
+			Error apiError `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		errResp.Error.Status = resp.StatusCode
+		return &errResp.Error
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
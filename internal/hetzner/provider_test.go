@@ -0,0 +1,434 @@
+package hetzner
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jamesboyd/mayfly/internal/cloud"
+)
+
+// fakeAPI is a stand-in for the Hetzner Cloud API. Servers report
+// "initializing" once before "running", and linger for one poll after
+// deletion; a firewall can't be deleted while a server still uses it.
+type fakeAPI struct {
+	mu        sync.Mutex
+	nextID    int64
+	servers   map[int64]*fakeServer
+	firewalls map[int64]bool
+
+	createServerErr bool
+	// pageSize, if set, splits server lists into pages of that many.
+	pageSize int
+}
+
+type fakeServer struct {
+	body     map[string]any
+	polls    int
+	deleting bool
+	off      bool
+	firewall int64
+}
+
+func newFakeAPI(t *testing.T) (*fakeAPI, *Provider) {
+	t.Helper()
+
+	f := &fakeAPI{servers: map[int64]*fakeServer{}, firewalls: map[int64]bool{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /server_types", f.listServerTypes)
+	mux.HandleFunc("GET /images", f.listImages)
+	mux.HandleFunc("GET /firewalls", f.listFirewalls)
+	mux.HandleFunc("POST /firewalls", f.createFirewall)
+	mux.HandleFunc("DELETE /firewalls/{id}", f.deleteFirewall)
+	mux.HandleFunc("GET /servers", f.listServers)
+	mux.HandleFunc("POST /servers", f.createServer)
+	mux.HandleFunc("GET /servers/{id}", f.getServer)
+	mux.HandleFunc("DELETE /servers/{id}", f.deleteServer)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer hc-token" {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "unable to authenticate")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	p, err := New("hc-token", "fsn1", WithBaseURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.pollInterval = time.Millisecond
+	return f, p
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	writeJSON(w, status, map[string]any{"error": map[string]string{"code": code, "message": msg}})
+}
+
+func pathID(r *http.Request) int64 {
+	id, _ := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	return id
+}
+
+func (f *fakeAPI) listServerTypes(w http.ResponseWriter, r *http.Request) {
+	archs := map[string]string{"cpx11": "x86", "cax11": "arm"}
+	arch, ok := archs[r.URL.Query().Get("name")]
+	if !ok {
+		writeJSON(w, http.StatusOK, map[string]any{"server_types": []any{}})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"server_types": []map[string]any{{"name": r.URL.Query().Get("name"), "architecture": arch}}})
+}
+
+func (f *fakeAPI) listImages(w http.ResponseWriter, r *http.Request) {
+	ids := map[string]int64{
+		"ubuntu-24.04/x86": 161547269,
+		"ubuntu-24.04/arm": 161547270,
+		"debian-12/x86":    114690387,
+	}
+	name := r.URL.Query().Get("name")
+	id, ok := ids[name+"/"+r.URL.Query().Get("architecture")]
+	if !ok {
+		writeJSON(w, http.StatusOK, map[string]any{"images": []any{}})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"images": []map[string]any{{"id": id, "name": name}}})
+}
+
+func (f *fakeAPI) listServers(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Query().Get("label_selector") != "mayfly=true" {
+		writeError(w, http.StatusBadRequest, "invalid_input", "want the mayfly label selector")
+		return
+	}
+	var ids []int64
+	for id := range f.servers {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	var next any
+	if f.pageSize > 0 {
+		start := min((page-1)*f.pageSize, len(ids))
+		end := min(start+f.pageSize, len(ids))
+		if end < len(ids) {
+			next = page + 1
+		}
+		ids = ids[start:end]
+	}
+	servers := []map[string]any{}
+	for _, id := range ids {
+		servers = append(servers, f.render(id))
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"servers": servers,
+		"meta":    map[string]any{"pagination": map[string]any{"next_page": next}},
+	})
+}
+
+func (f *fakeAPI) listFirewalls(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	firewalls := []map[string]any{}
+	for id := range f.firewalls {
+		firewalls = append(firewalls, map[string]any{"id": id, "name": "mayfly-fsn1-abc123", "created": "2026-01-02T03:04:05+00:00"})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"firewalls": firewalls,
+		"meta":      map[string]any{"pagination": map[string]any{"next_page": nil}},
+	})
+}
+
+func (f *fakeAPI) createFirewall(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.nextID++
+	f.firewalls[f.nextID] = true
+	writeJSON(w, http.StatusCreated, map[string]any{"firewall": map[string]any{"id": f.nextID}})
+}
+
+func (f *fakeAPI) deleteFirewall(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := pathID(r)
+	if !f.firewalls[id] {
+		writeError(w, http.StatusNotFound, "not_found", "firewall not found")
+		return
+	}
+	for _, s := range f.servers {
+		if s.firewall == id {
+			writeError(w, http.StatusConflict, "resource_in_use", "firewall is still in use")
+			return
+		}
+	}
+	delete(f.firewalls, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeAPI) createServer(w http.ResponseWriter, r *http.Request) {
+	var body map[string]any
+	json.NewDecoder(r.Body).Decode(&body)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.createServerErr {
+		writeError(w, http.StatusPreconditionFailed, "resource_unavailable", "server type unavailable in location")
+		return
+	}
+
+	fws := body["firewalls"].([]any)
+	fw := int64(fws[0].(map[string]any)["firewall"].(float64))
+
+	f.nextID++
+	f.servers[f.nextID] = &fakeServer{body: body, firewall: fw}
+	writeJSON(w, http.StatusCreated, map[string]any{"server": f.render(f.nextID)})
+}
+
+func (f *fakeAPI) getServer(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := pathID(r)
+	s, ok := f.servers[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "server not found")
+		return
+	}
+	s.polls++
+	if s.deleting && s.polls > 1 {
+		delete(f.servers, id)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"server": f.render(id)})
+}
+
+func (f *fakeAPI) deleteServer(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.servers[pathID(r)]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "server not found")
+		return
+	}
+	s.deleting, s.polls = true, 0
+	writeJSON(w, http.StatusOK, map[string]any{"action": map[string]any{"status": "running"}})
+}
+
+// render returns a server as the API shows it. The caller must hold f.mu.
+func (f *fakeAPI) render(id int64) map[string]any {
+	s := f.servers[id]
+	status := "running"
+	switch {
+	case s == nil || s.deleting:
+		status = "deleting"
+	case s.polls == 0:
+		status = "initializing"
+	}
+	body := map[string]any{}
+	if s != nil {
+		body = s.body
+		if s.off {
+			status = "off"
+		}
+	}
+	return map[string]any{
+		"id":      id,
+		"name":    body["name"],
+		"status":  status,
+		"created": "2026-01-02T03:04:05+00:00",
+		"labels":  body["labels"],
+		"public_net": map[string]any{
+			"ipv4":      map[string]any{"ip": "203.0.113.7"},
+			"firewalls": []map[string]any{{"id": f.firewallOf(id), "status": "applied"}},
+		},
+	}
+}
+
+// firewallOf returns the firewall a server was created with. The caller must
+// hold f.mu.
+func (f *fakeAPI) firewallOf(id int64) int64 {
+	if s := f.servers[id]; s != nil {
+		return s.firewall
+	}
+	return 0
+}
+
+func (f *fakeAPI) counts() (servers, firewalls int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.servers), len(f.firewalls)
+}
+
+func testSpec(imageID string) cloud.Spec {
+	return cloud.Spec{
+		Name:         "mayfly-fsn1-abc123",
+		ImageID:      imageID,
+		InstanceType: "cpx11",
+		UserData:     base64.StdEncoding.EncodeToString([]byte("#!/bin/bash\necho hi\n")),
+		Deadline:     time.Unix(1767236400, 0),
+	}
+}
+
+func TestProvisionAndTeardown(t *testing.T) {
+	f, p := newFakeAPI(t)
+	ctx := context.Background()
+
+	imageID, err := p.LookupImage(ctx, "ubuntu-24.04", "cpx11")
+	if err != nil {
+		t.Fatalf("LookupImage: %v", err)
+	}
+	if imageID != "161547269" {
+		t.Errorf("LookupImage = %s, want 161547269", imageID)
+	}
+
+	res, err := p.Provision(ctx, testSpec(imageID))
+	if err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+	if res.InstanceID == "" || res.SecurityGroupID == "" || res.PublicIP != "203.0.113.7" {
+		t.Errorf("Provision = %+v, want a server, firewall and public IP", res)
+	}
+
+	id, _ := strconv.ParseInt(res.InstanceID, 10, 64)
+	body := f.servers[id].body
+	if body["user_data"] != "#!/bin/bash\necho hi\n" {
+		t.Errorf("user_data = %q, want the decoded script", body["user_data"])
+	}
+	if body["location"] != "fsn1" || body["server_type"] != "cpx11" {
+		t.Errorf("server created in %v as %v, want fsn1 as cpx11", body["location"], body["server_type"])
+	}
+	labels := body["labels"].(map[string]any)
+	if labels["mayfly"] != "true" || labels["mayfly-deadline"] != "1767236400" {
+		t.Errorf("labels = %v, want mayfly=true and the deadline", labels)
+	}
+
+	inst, err := p.Describe(ctx, res.InstanceID)
+	if err != nil {
+		t.Fatalf("Describe: %v", err)
+	}
+	if inst.State != "running" || inst.LaunchTime.IsZero() {
+		t.Errorf("Describe = %+v, want a running server with a launch time", inst)
+	}
+
+	if err := p.Teardown(ctx, res); err != nil {
+		t.Fatalf("Teardown: %v", err)
+	}
+	if servers, firewalls := f.counts(); servers != 0 || firewalls != 0 {
+		t.Errorf("left %d servers and %d firewalls", servers, firewalls)
+	}
+
+	// Tearing down again is a no-op.
+	if err := p.Teardown(ctx, res); err != nil {
+		t.Errorf("second Teardown: %v", err)
+	}
+}
+
+func TestProvisionFailureReturnsFirewall(t *testing.T) {
+	f, p := newFakeAPI(t)
+	f.createServerErr = true
+
+	res, err := p.Provision(context.Background(), testSpec("161547269"))
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) || apiErr.Code != "resource_unavailable" {
+		t.Fatalf("Provision error = %v, want resource_unavailable", err)
+	}
+	if res.SecurityGroupID == "" || res.InstanceID != "" {
+		t.Fatalf("Provision = %+v, want only the firewall", res)
+	}
+
+	if err := p.Teardown(context.Background(), res); err != nil {
+		t.Fatalf("Teardown: %v", err)
+	}
+	if _, firewalls := f.counts(); firewalls != 0 {
+		t.Errorf("left %d firewalls", firewalls)
+	}
+}
+
+func TestListTagged(t *testing.T) {
+	f, p := newFakeAPI(t)
+	f.pageSize = 1
+	ctx := context.Background()
+
+	var ids []string
+	for range 2 {
+		res, err := p.Provision(ctx, testSpec("161547269"))
+		if err != nil {
+			t.Fatalf("Provision: %v", err)
+		}
+		ids = append(ids, res.InstanceID)
+	}
+	id, _ := strconv.ParseInt(ids[1], 10, 64)
+	f.servers[id].off = true
+
+	servers, firewalls, err := p.ListTagged(ctx)
+	if err != nil {
+		t.Fatalf("ListTagged: %v", err)
+	}
+	if len(servers) != 2 || len(firewalls) != 2 {
+		t.Fatalf("ListTagged = %d servers and %d firewalls, want 2 of each across pages", len(servers), len(firewalls))
+	}
+	s := servers[1]
+	if s.ID != ids[1] || s.Name != "mayfly-fsn1-abc123" || s.Status != "off" {
+		t.Errorf("server = %+v, want %s named mayfly-fsn1-abc123 and off", s, ids[1])
+	}
+	if !s.Deadline.Equal(time.Unix(1767236400, 0)) || s.Created.IsZero() {
+		t.Errorf("server deadline = %v, created = %v, want the labelled deadline and a creation time", s.Deadline, s.Created)
+	}
+	if len(s.FirewallIDs) != 1 || s.FirewallIDs[0] == "" {
+		t.Errorf("server firewalls = %v, want the one it was created with", s.FirewallIDs)
+	}
+}
+
+func TestLookupImageMatchesArchitecture(t *testing.T) {
+	_, p := newFakeAPI(t)
+	ctx := context.Background()
+
+	if id, err := p.LookupImage(ctx, "ubuntu-24.04", "cax11"); err != nil || id != "161547270" {
+		t.Errorf("LookupImage(ubuntu-24.04, cax11) = %s, %v, want the arm image 161547270", id, err)
+	}
+	if id, err := p.LookupImage(ctx, "debian-12", "cpx11"); err != nil || id != "114690387" {
+		t.Errorf("LookupImage(debian-12, cpx11) = %s, %v, want 114690387", id, err)
+	}
+	if _, err := p.LookupImage(ctx, "ubuntu-24.04", "cpx99"); err == nil {
+		t.Error("LookupImage succeeded for an unknown server type")
+	}
+	if _, err := p.LookupImage(ctx, "al2023", "cpx11"); err == nil {
+		t.Error("LookupImage(al2023) succeeded on Hetzner")
+	}
+}
+
+func TestSetDeadlineUnsupported(t *testing.T) {
+	_, p := newFakeAPI(t)
+	if err := p.SetDeadline(context.Background(), "1", time.Now()); err == nil {
+		t.Error("SetDeadline succeeded, want an error")
+	}
+}
+
+func TestNewRequiresToken(t *testing.T) {
+	if _, err := New("", "fsn1"); err == nil {
+		t.Error("New without a token succeeded")
+	}
+}
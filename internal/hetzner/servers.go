@@ -0,0 +1,216 @@
+package hetzner
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jamesboyd/mayfly/internal/cloud"
+)
+
+type server struct {
+	ID        int64             `json:"id"`
+	Name      string            `json:"name"`
+	Status    string            `json:"status"`
+	Created   time.Time         `json:"created"`
+	Labels    map[string]string `json:"labels"`
+	PublicNet struct {
+		IPv4 struct {
+			IP string `json:"ip"`
+		} `json:"ipv4"`
+		Firewalls []struct {
+			ID int64 `json:"id"`
+		} `json:"firewalls"`
+	} `json:"public_net"`
+}
+
+// labels marks a server as mayfly's and carries its deadline. Label values
+// can't contain colons, so the deadline is in Unix seconds.
+func labels(deadline time.Time) map[string]string {
+	return map[string]string{
+		"mayfly":          "true",
+		"mayfly-deadline": strconv.FormatInt(deadline.Unix(), 10),
+	}
+}
+
+// MaxUserData returns the 32 KiB of user-data Hetzner Cloud accepts.
+func (p *Provider) MaxUserData() int {
+	return 32 * 1024
+}
+
+// Provision creates a firewall allowing Tailscale's WireGuard port and
+// launches a server behind it, then waits for the server to run.
+func (p *Provider) Provision(ctx context.Context, spec cloud.Spec) (*cloud.Resources, error) {
+	res := &cloud.Resources{}
+
+	fwID, err := p.createFirewall(ctx, spec.Name)
+	res.SecurityGroupID = fwID
+	if err != nil {
+		return res, err
+	}
+
+	// Hetzner takes user-data as plain text.
+	userData, err := base64.StdEncoding.DecodeString(spec.UserData)
+	if err != nil {
+		return res, fmt.Errorf("decoding user-data: %w", err)
+	}
+	fw, _ := strconv.ParseInt(fwID, 10, 64)
+
+	var created struct {
+		Server server `json:"server"`
+	}
+	err = p.do(ctx, http.MethodPost, "/servers", map[string]any{
+		"name":               spec.Name,
+		"server_type":        spec.InstanceType,
+		"image":              spec.ImageID,
+		"location":           p.location,
+		"user_data":          string(userData),
+		"labels":             labels(spec.Deadline),
+		"firewalls":          []map[string]any{{"firewall": fw}},
+		"start_after_create": true,
+	}, &created)
+	if err != nil {
+		return res, fmt.Errorf("creating server: %w", err)
+	}
+	res.InstanceID = strconv.FormatInt(created.Server.ID, 10)
+
+	// Wait for the server to reach running state.
+	inst, err := p.waitFor(ctx, res.InstanceID, 5*time.Minute, func(s *server) bool { return s.Status == "running" })
+	if err != nil {
+		return res, fmt.Errorf("waiting for server to start: %w", err)
+	}
+	res.PublicIP = inst.PublicNet.IPv4.IP
+
+	return res, nil
+}
+
+func (p *Provider) createFirewall(ctx context.Context, name string) (string, error) {
+	var created struct {
+		Firewall struct {
+			ID int64 `json:"id"`
+		} `json:"firewall"`
+	}
+	err := p.do(ctx, http.MethodPost, "/firewalls", map[string]any{
+		"name":   name,
+		"labels": map[string]string{"mayfly": "true"},
+		"rules": []map[string]any{{
+			"description": "Tailscale WireGuard",
+			"direction":   "in",
+			"protocol":    "udp",
+			"port":        "41641",
+			"source_ips":  []string{"0.0.0.0/0", "::/0"},
+		}},
+	}, &created)
+	if err != nil {
+		return "", fmt.Errorf("creating firewall: %w", err)
+	}
+	return strconv.FormatInt(created.Firewall.ID, 10), nil
+}
+
+// Teardown deletes the server and then the firewall.
+// Pass context.Background() so cleanup always completes.
+func (p *Provider) Teardown(ctx context.Context, res *cloud.Resources) error {
+	var firstErr error
+
+	if res.InstanceID != "" {
+		err := p.do(ctx, http.MethodDelete, "/servers/"+res.InstanceID, nil, nil)
+		if err != nil && !isNotFound(err) {
+			firstErr = fmt.Errorf("deleting server: %w", err)
+		} else {
+			// Wait for the server to go before deleting the firewall, which
+			// can't be deleted while applied to it.
+			_, err := p.waitFor(ctx, res.InstanceID, 5*time.Minute, nil)
+			if !isNotFound(err) {
+				firstErr = fmt.Errorf("waiting for server deletion: %w", err)
+			}
+		}
+	}
+
+	if res.SecurityGroupID != "" {
+		if err := p.deleteFirewall(ctx, res.SecurityGroupID); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("deleting firewall: %w", err)
+		}
+	}
+
+	return firstErr
+}
+
+// deleteFirewall deletes a firewall, retrying while it is still detaching
+// from a deleted server.
+func (p *Provider) deleteFirewall(ctx context.Context, id string) error {
+	deadline := time.Now().Add(time.Minute)
+	for {
+		err := p.do(ctx, http.MethodDelete, "/firewalls/"+id, nil, nil)
+		var apiErr *apiError
+		switch {
+		case err == nil || isNotFound(err):
+			return nil
+		case !errors.As(err, &apiErr) || apiErr.Code != "resource_in_use" || time.Now().After(deadline):
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(p.pollInterval):
+		}
+	}
+}
+
+// Describe returns the current status and public IP of a server.
+func (p *Provider) Describe(ctx context.Context, instanceID string) (*cloud.Instance, error) {
+	s, err := p.getServer(ctx, instanceID)
+	if err != nil {
+		return nil, fmt.Errorf("describing server: %w", err)
+	}
+	return &cloud.Instance{
+		State:      s.Status,
+		PublicIP:   s.PublicNet.IPv4.IP,
+		LaunchTime: s.Created,
+		Gone:       s.Status == "stopping" || s.Status == "off" || s.Status == "deleting",
+	}, nil
+}
+
+// SetDeadline is not supported: the server has no way to read its labels, so
+// its self-destruct timer would still fire at the original deadline.
+func (p *Provider) SetDeadline(ctx context.Context, instanceID string, deadline time.Time) error {
+	return fmt.Errorf("hetzner nodes can't be extended: the server can't see a new deadline, so it would still shut itself down at the original one")
+}
+
+func (p *Provider) getServer(ctx context.Context, id string) (*server, error) {
+	var resp struct {
+		Server server `json:"server"`
+	}
+	if err := p.do(ctx, http.MethodGet, "/servers/"+id, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Server, nil
+}
+
+// waitFor polls a server until done reports true or, with a nil done, until
+// the server is gone, in which case the not_found error is returned.
+func (p *Provider) waitFor(ctx context.Context, id string, timeout time.Duration, done func(*server) bool) (*server, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		s, err := p.getServer(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if done != nil && done(s) {
+			return s, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out after %s", timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(p.pollInterval):
+		}
+	}
+}
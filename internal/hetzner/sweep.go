@@ -0,0 +1,102 @@
+package hetzner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// TaggedServer is a server carrying the mayfly=true label.
+type TaggedServer struct {
+	ID          string
+	Name        string
+	Status      string
+	Deadline    time.Time // zero if the deadline label is missing or malformed
+	Created     time.Time
+	FirewallIDs []string
+}
+
+// TaggedFirewall is a firewall carrying the mayfly=true label.
+type TaggedFirewall struct {
+	ID      string
+	Name    string
+	Created time.Time
+}
+
+// pagination is the part of a list response that points to the next page.
+type pagination struct {
+	Meta struct {
+		Pagination struct {
+			NextPage int `json:"next_page"`
+		} `json:"pagination"`
+	} `json:"meta"`
+}
+
+// ListTagged returns the servers and firewalls in the project, in every
+// location, that carry the mayfly=true label.
+func (p *Provider) ListTagged(ctx context.Context) ([]TaggedServer, []TaggedFirewall, error) {
+	var servers []TaggedServer
+	for page := 1; page != 0; {
+		var resp struct {
+			Servers []server `json:"servers"`
+			pagination
+		}
+		if err := p.do(ctx, http.MethodGet, listPath("/servers", page), nil, &resp); err != nil {
+			return nil, nil, fmt.Errorf("listing servers: %w", err)
+		}
+		for _, s := range resp.Servers {
+			ts := TaggedServer{
+				ID:      strconv.FormatInt(s.ID, 10),
+				Name:    s.Name,
+				Status:  s.Status,
+				Created: s.Created,
+			}
+			if secs, err := strconv.ParseInt(s.Labels["mayfly-deadline"], 10, 64); err == nil {
+				ts.Deadline = time.Unix(secs, 0)
+			}
+			for _, fw := range s.PublicNet.Firewalls {
+				ts.FirewallIDs = append(ts.FirewallIDs, strconv.FormatInt(fw.ID, 10))
+			}
+			servers = append(servers, ts)
+		}
+		page = resp.Meta.Pagination.NextPage
+	}
+
+	var firewalls []TaggedFirewall
+	for page := 1; page != 0; {
+		var resp struct {
+			Firewalls []struct {
+				ID      int64     `json:"id"`
+				Name    string    `json:"name"`
+				Created time.Time `json:"created"`
+			} `json:"firewalls"`
+			pagination
+		}
+		if err := p.do(ctx, http.MethodGet, listPath("/firewalls", page), nil, &resp); err != nil {
+			return nil, nil, fmt.Errorf("listing firewalls: %w", err)
+		}
+		for _, fw := range resp.Firewalls {
+			firewalls = append(firewalls, TaggedFirewall{
+				ID:      strconv.FormatInt(fw.ID, 10),
+				Name:    fw.Name,
+				Created: fw.Created,
+			})
+		}
+		page = resp.Meta.Pagination.NextPage
+	}
+
+	return servers, firewalls, nil
+}
+
+// listPath returns the path of one page of mayfly-labelled resources.
+func listPath(path string, page int) string {
+	q := url.Values{
+		"label_selector": {"mayfly=true"},
+		"page":           {strconv.Itoa(page)},
+		"per_page":       {"50"},
+	}
+	return path + "?" + q.Encode()
+}
@@ -0,0 +1,89 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jamesboyd/mayfly/internal/cloud"
+	"github.com/jamesboyd/mayfly/internal/display"
+	"github.com/jamesboyd/mayfly/internal/userdata"
+)
+
+// consolePollInterval is how often a booting node's console is read for
+// progress. Reading it is slower and more rate-limited than listing devices.
+var consolePollInterval = 10 * time.Second
+
+// bootReporter shows the progress a node's bootstrap script reports on its
+// serial console. A nil *bootReporter, for providers that can't read the
+// console, reports nothing.
+type bootReporter struct {
+	console    cloud.ConsoleReader
+	instanceID string
+
+	next     time.Time
+	shown    map[string]bool
+	progress userdata.Progress
+}
+
+func newBootReporter(provider cloud.Provider, instanceID string) *bootReporter {
+	console, ok := provider.(cloud.ConsoleReader)
+	if !ok {
+		return nil
+	}
+	return &bootReporter{console: console, instanceID: instanceID, shown: map[string]bool{}}
+}
+
+// poll reads the console at most once per consolePollInterval and shows any
+// newly reported stages. It returns an error once the script has failed.
+func (b *bootReporter) poll(ctx context.Context) error {
+	if b == nil || time.Now().Before(b.next) {
+		return nil
+	}
+	b.next = time.Now().Add(consolePollInterval)
+
+	b.refresh(ctx)
+	if b.progress.Failure != "" {
+		return fmt.Errorf("bootstrap script failed at %s", b.progress.Failure)
+	}
+	return nil
+}
+
+// refresh re-reads the console. The console may not be readable yet while
+// the instance boots, so errors leave the last progress in place.
+func (b *bootReporter) refresh(ctx context.Context) {
+	out, err := b.console.ConsoleOutput(ctx, b.instanceID)
+	if err != nil {
+		return
+	}
+	b.progress = userdata.ParseProgress(out)
+
+	for _, stage := range b.progress.Stages {
+		if !b.shown[stage] {
+			b.shown[stage] = true
+			display.Success(userdata.DescribeStage(stage))
+		}
+	}
+}
+
+// explain shows why the node hasn't joined as far as the console tells: the
+// failing line and the end of the script's output, or the last stage reached.
+func (b *bootReporter) explain(ctx context.Context) {
+	if b == nil {
+		return
+	}
+	b.refresh(ctx)
+
+	switch p := b.progress; {
+	case p.Failure != "":
+		display.Error(fmt.Sprintf("Bootstrap script failed at %s. Its last output was:", p.Failure))
+		for _, line := range p.Log {
+			fmt.Println("    " + line)
+		}
+	case len(p.Stages) == 0:
+		display.Warn("The bootstrap script has reported no progress (the console of older instance types can lag by minutes)")
+	default:
+		last := p.Stages[len(p.Stages)-1]
+		display.Warn(fmt.Sprintf("The bootstrap script last reported: %s", userdata.DescribeStage(last)))
+	}
+}
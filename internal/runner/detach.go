@@ -0,0 +1,73 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/jamesboyd/mayfly/internal/config"
+	"github.com/jamesboyd/mayfly/internal/state"
+)
+
+// detach starts `mayfly supervise <name>` as a background process that
+// outlives this one, and waits for it to take ownership of the node's
+// pidfile. It returns the supervisor's PID and log file path.
+func detach(cfg *config.Config, name string) (int, string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, "", fmt.Errorf("locating mayfly executable: %w", err)
+	}
+
+	logPath, err := state.LogPath(name)
+	if err != nil {
+		return 0, "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(logPath), 0700); err != nil {
+		return 0, "", err
+	}
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, "", fmt.Errorf("opening supervisor log: %w", err)
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(exe, "supervise", name)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = detachedProcAttr()
+	// Pass credentials through the environment rather than argv, which is
+	// visible to other users.
+	cmd.Env = append(os.Environ(),
+		"MAYFLY_CONTROL="+cfg.Control,
+		"TAILSCALE_API_KEY="+cfg.TailscaleAPIKey,
+		"TAILSCALE_OAUTH_CLIENT_ID="+cfg.TailscaleOAuthClientID,
+		"TAILSCALE_OAUTH_CLIENT_SECRET="+cfg.TailscaleOAuthClientSecret,
+		"TAILSCALE_TAILNET="+cfg.TailscaleTailnet,
+		"HEADSCALE_URL="+cfg.HeadscaleURL,
+		"HEADSCALE_API_KEY="+cfg.HeadscaleAPIKey,
+		"HEADSCALE_USER="+cfg.HeadscaleUser,
+		"HCLOUD_TOKEN="+cfg.HetznerToken,
+	)
+
+	if err := cmd.Start(); err != nil {
+		return 0, "", fmt.Errorf("starting supervisor: %w", err)
+	}
+	pid := cmd.Process.Pid
+
+	// Wait for the supervisor to claim the pidfile. If it never does, kill it
+	// so it can't tear down the node behind the foreground countdown's back.
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if owner, err := state.LoadPID(name); err == nil && owner == pid {
+			cmd.Process.Release()
+			return pid, logPath, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	cmd.Process.Kill()
+	cmd.Wait()
+	return 0, "", fmt.Errorf("supervisor did not start — see %s", logPath)
+}
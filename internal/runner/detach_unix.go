@@ -0,0 +1,11 @@
+//go:build !windows
+
+package runner
+
+import "syscall"
+
+// detachedProcAttr starts the supervisor in its own session so it survives
+// the terminal closing.
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
@@ -0,0 +1,417 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	mayaws "github.com/jamesboyd/mayfly/internal/aws"
+	"github.com/jamesboyd/mayfly/internal/cloud"
+	"github.com/jamesboyd/mayfly/internal/config"
+	"github.com/jamesboyd/mayfly/internal/control"
+	"github.com/jamesboyd/mayfly/internal/display"
+	"github.com/jamesboyd/mayfly/internal/hetzner"
+	"github.com/jamesboyd/mayfly/internal/state"
+)
+
+// regionSweep holds what GC found in one AWS region, in AWS's global IAM, or
+// across a Hetzner project.
+type regionSweep struct {
+	region     string
+	provider   cloud.Provider
+	instances  []sweptInstance
+	groups     []sweptGroup
+	groupKind  string // what the provider calls a group: "security group" or "firewall"
+	parameters []sweptAuthKey
+	profiles   []sweptAuthKey
+	err        error
+}
+
+// sweptInstance is a mayfly-tagged instance or server.
+type sweptInstance struct {
+	ID         string
+	Name       string
+	State      string
+	Deadline   time.Time // zero if the deadline tag is missing or malformed
+	LaunchTime time.Time
+	GroupIDs   []string
+	// Off is set for a server that has powered itself off at its deadline
+	// but, unlike an EC2 instance, still exists.
+	Off bool
+	// Resources is what tearing the instance down deletes.
+	Resources *cloud.Resources
+}
+
+// sweptGroup is a mayfly-tagged security group or firewall.
+type sweptGroup struct {
+	ID      string
+	Name    string
+	Created time.Time // zero if unknown
+}
+
+// sweptAuthKey is an auth key parameter, or an instance profile and its role,
+// that was created for a node.
+type sweptAuthKey struct {
+	Name    string
+	Node    string // "" if unknown
+	Created time.Time
+}
+
+// groupGracePeriod is how long a security group, auth key parameter or
+// instance profile is left alone after it is created, since a teammate's
+// `up` may not have launched its instance yet.
+// untaggedMaxAge is how long an instance without a deadline tag may run
+// before it counts as stale: the default maximum lifetime of a node.
+var (
+	groupGracePeriod = 10 * time.Minute
+	untaggedMaxAge   = config.DefaultMaxLifetime
+)
+
+// GC finds mayfly-tagged instances, security groups and auth key parameters
+// in every enabled region, mayfly's instance profiles and roles,
+// mayfly-labelled servers and firewalls in the Hetzner project if a token is
+// set, plus mayfly-* tailnet devices, that no live node accounts for. It
+// prints the plan and, unless dryRun is set, deletes them after
+// confirmation.
+//
+// An instance is stale once its deadline tag has passed, or if it has none,
+// once it has run for longer than a node may live, unless a live mayfly
+// process on this machine owns it, so a teammate's running node is left
+// alone. A Hetzner server that has powered itself off is stale too. A
+// security group is stale if no kept instance uses it and it is old enough
+// that no `up` can still be about to launch into it. An auth key parameter or
+// instance profile is stale on the same terms if no instance carries the
+// name of the node it was created for; a stale instance's own are deleted
+// with it. A device is stale if it is offline and no kept instance carries
+// its hostname.
+func GC(ctx context.Context, cfg *config.Config, dryRun bool) error {
+	sweeps, err := sweepAWS(ctx, cfg)
+	if err != nil {
+		if cfg.HetznerToken == "" {
+			return err
+		}
+		display.Warn(fmt.Sprintf("Skipping AWS: %v", err))
+	}
+	if cfg.HetznerToken != "" {
+		sweeps = append(sweeps, sweepHetzner(ctx, cfg))
+	}
+
+	// Nodes a live process on this machine is managing are never stale.
+	owned := map[string]bool{}
+	recorded := map[string]string{} // instance ID -> node name
+	if nodes, err := state.List(); err != nil {
+		display.Warn(fmt.Sprintf("Could not read state files: %v", err))
+	} else {
+		for _, n := range nodes {
+			recorded[n.InstanceID] = n.Name
+			if liveOwner(n.Name) != 0 {
+				owned[n.InstanceID] = true
+			}
+		}
+	}
+
+	now := time.Now()
+
+	// Auth key parameters and instance profiles are found by node name, and
+	// instance profiles are global, so collect every instance's name first.
+	// If any region went unswept, its nodes are unknown.
+	instanceNames := map[string]bool{}
+	var unswept bool
+	for _, sw := range sweeps {
+		unswept = unswept || sw.err != nil
+		for _, inst := range sw.instances {
+			instanceNames[inst.Name] = true
+		}
+	}
+
+	keptNames := map[string]bool{}
+	var staleCount int
+	plans := make([]regionSweep, 0, len(sweeps))
+
+	for _, sw := range sweeps {
+		if sw.err != nil {
+			display.Warn(fmt.Sprintf("Skipping %s: %v", sw.region, sw.err))
+			continue
+		}
+
+		plan := regionSweep{region: sw.region, provider: sw.provider, groupKind: sw.groupKind}
+		keptGroups := map[string]bool{}
+		for _, inst := range sw.instances {
+			if owned[inst.ID] || !instanceExpired(inst, now) {
+				keptNames[control.Hostname(inst.Name, inst.ID)] = true
+				keptNames[inst.Name] = true // joined before hostnames carried the instance ID
+				for _, id := range inst.GroupIDs {
+					keptGroups[id] = true
+				}
+				continue
+			}
+			plan.instances = append(plan.instances, inst)
+		}
+		for _, sg := range sw.groups {
+			if !keptGroups[sg.ID] && now.Sub(sg.Created) >= groupGracePeriod {
+				plan.groups = append(plan.groups, sg)
+			}
+		}
+		plan.parameters = unclaimedAuthKeys(sw.parameters, instanceNames, now)
+		if unswept && len(sw.profiles) > 0 {
+			display.Warn("Skipping instance profiles, since not every region could be scanned")
+		} else {
+			plan.profiles = unclaimedAuthKeys(sw.profiles, instanceNames, now)
+		}
+
+		staleCount += len(plan.instances) + len(plan.groups) + len(plan.parameters) + len(plan.profiles)
+		plans = append(plans, plan)
+	}
+
+	tsClient := newControl(cfg)
+	var staleDevices []control.Device
+	if devices, err := tsClient.ListDevices(ctx, "mayfly-"); err != nil {
+		display.Warn(fmt.Sprintf("Could not list tailnet devices: %v", err))
+	} else {
+		for _, d := range devices {
+			if !d.Online() && !keptNames[d.Hostname] {
+				staleDevices = append(staleDevices, d)
+			}
+		}
+	}
+	staleCount += len(staleDevices)
+
+	if staleCount == 0 {
+		display.Success("No stale mayfly resources found")
+		return nil
+	}
+
+	display.Warn(fmt.Sprintf("Found %d stale resources:", staleCount))
+	for _, plan := range plans {
+		for _, inst := range plan.instances {
+			var reason string
+			switch {
+			case inst.Off:
+				reason = "powered off"
+			case inst.Deadline.IsZero():
+				reason = fmt.Sprintf("no deadline tag, launched %s ago", now.Sub(inst.LaunchTime).Truncate(time.Minute))
+			default:
+				reason = fmt.Sprintf("expired %s ago", now.Sub(inst.Deadline).Truncate(time.Minute))
+			}
+			display.Info(plan.region, fmt.Sprintf("instance %s (%s, %s, %s)", inst.ID, inst.Name, inst.State, reason))
+		}
+		for _, sg := range plan.groups {
+			display.Info(plan.region, fmt.Sprintf("%s %s (%s)", plan.groupKind, sg.ID, sg.Name))
+		}
+		for _, param := range plan.parameters {
+			display.Info(plan.region, fmt.Sprintf("auth key parameter %s", param.Name))
+		}
+		for _, profile := range plan.profiles {
+			display.Info(plan.region, fmt.Sprintf("instance profile and role %s", profile.Name))
+		}
+	}
+	for _, d := range staleDevices {
+		display.Info("tailnet", fmt.Sprintf("device %s (%s, last seen %s)", d.ID, d.Hostname, d.LastSeen.Format(time.RFC3339)))
+	}
+
+	if dryRun {
+		display.Status("Dry run — nothing deleted")
+		return nil
+	}
+	if !display.Confirm("Delete these resources?") {
+		display.Status("Aborted — nothing deleted")
+		return nil
+	}
+
+	var failed int
+	for _, d := range staleDevices {
+		if err := tsClient.RemoveDevice(context.Background(), d.ID); err != nil {
+			display.Warn(fmt.Sprintf("Failed to remove device %s: %v", d.Hostname, err))
+			failed++
+		} else {
+			display.Success(fmt.Sprintf("Removed device %s", d.Hostname))
+		}
+	}
+
+	for _, plan := range plans {
+		// Instances go first: a security group can't be deleted while in use.
+		for _, inst := range plan.instances {
+			display.Status(fmt.Sprintf("Terminating %s in %s...", inst.ID, plan.region))
+			if err := plan.provider.Teardown(context.Background(), inst.Resources); err != nil {
+				display.Warn(fmt.Sprintf("Failed to terminate %s: %v", inst.ID, err))
+				failed++
+				continue
+			}
+			display.Success(fmt.Sprintf("Terminated %s", inst.ID))
+			if name, ok := recorded[inst.ID]; ok {
+				if err := state.Clear(name); err != nil {
+					display.Warn(fmt.Sprintf("Could not clear state file: %v", err))
+				}
+			}
+		}
+		for _, sg := range plan.groups {
+			if err := plan.provider.Teardown(context.Background(), &cloud.Resources{SecurityGroupID: sg.ID}); err != nil {
+				display.Warn(fmt.Sprintf("Failed to delete %s: %v", sg.ID, err))
+				failed++
+				continue
+			}
+			display.Success(fmt.Sprintf("Deleted %s %s", plan.groupKind, sg.ID))
+		}
+		for _, param := range plan.parameters {
+			if err := plan.provider.Teardown(context.Background(), &cloud.Resources{AuthKeyParameter: param.Name}); err != nil {
+				display.Warn(fmt.Sprintf("Failed to delete %s: %v", param.Name, err))
+				failed++
+				continue
+			}
+			display.Success(fmt.Sprintf("Deleted auth key parameter %s", param.Name))
+		}
+		for _, profile := range plan.profiles {
+			if err := plan.provider.Teardown(context.Background(), &cloud.Resources{InstanceProfile: profile.Name}); err != nil {
+				display.Warn(fmt.Sprintf("Failed to delete %s: %v", profile.Name, err))
+				failed++
+				continue
+			}
+			display.Success(fmt.Sprintf("Deleted instance profile and role %s", profile.Name))
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d resources could not be deleted", failed)
+	}
+	display.Success("All stale resources cleaned up")
+	return nil
+}
+
+// sweepAWS lists the mayfly-tagged instances, security groups and auth key
+// parameters in every enabled region, one sweep per region, plus one for
+// mayfly's instance profiles and roles in IAM.
+func sweepAWS(ctx context.Context, cfg *config.Config) ([]regionSweep, error) {
+	display.Status("Loading AWS configuration...")
+	base, err := mayaws.New(ctx, cfg.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	regions, err := base.EnabledRegions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	display.Status(fmt.Sprintf("Scanning %d regions for mayfly resources...", len(regions)))
+	sweeps := make([]regionSweep, len(regions))
+	var wg sync.WaitGroup
+	for i, region := range regions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sw := regionSweep{region: region, groupKind: "security group"}
+			provider, err := mayaws.New(ctx, region)
+			if err != nil {
+				sw.err = err
+				sweeps[i] = sw
+				return
+			}
+			sw.provider = provider
+
+			instances, groups, err := provider.ListTagged(ctx)
+			sw.err = err
+			for _, inst := range instances {
+				sw.instances = append(sw.instances, sweptInstance{
+					ID:         inst.ID,
+					Name:       inst.Name,
+					State:      inst.State,
+					Deadline:   inst.Deadline,
+					LaunchTime: inst.LaunchTime,
+					GroupIDs:   inst.SecurityGroupIDs,
+					Resources:  staleResources(provider, inst),
+				})
+			}
+			for _, sg := range groups {
+				sw.groups = append(sw.groups, sweptGroup{ID: sg.ID, Name: sg.Name, Created: sg.Created})
+			}
+			if sw.err == nil {
+				var params []mayaws.TaggedParameter
+				params, sw.err = provider.ListAuthKeyParameters(ctx)
+				for _, param := range params {
+					sw.parameters = append(sw.parameters, sweptAuthKey{Name: param.Name, Node: param.Node, Created: param.Modified})
+				}
+			}
+			sweeps[i] = sw
+		}()
+	}
+	wg.Wait()
+
+	sw := regionSweep{region: "iam", provider: base}
+	profiles, err := base.ListInstanceProfiles(ctx)
+	sw.err = err
+	for _, profile := range profiles {
+		sw.profiles = append(sw.profiles, sweptAuthKey{Name: profile.Name, Node: profile.Name, Created: profile.Created})
+	}
+	return append(sweeps, sw), nil
+}
+
+// sweepHetzner lists the mayfly-labelled servers and firewalls in the Hetzner
+// project, which spans every location.
+func sweepHetzner(ctx context.Context, cfg *config.Config) regionSweep {
+	display.Status("Scanning Hetzner Cloud for mayfly resources...")
+	sw := regionSweep{region: "hetzner", groupKind: "firewall"}
+	provider, err := hetzner.New(cfg.HetznerToken, "")
+	if err != nil {
+		sw.err = err
+		return sw
+	}
+	sw.provider = provider
+
+	servers, firewalls, err := provider.ListTagged(ctx)
+	sw.err = err
+	for _, s := range servers {
+		sw.instances = append(sw.instances, sweptInstance{
+			ID:         s.ID,
+			Name:       s.Name,
+			State:      s.Status,
+			Deadline:   s.Deadline,
+			LaunchTime: s.Created,
+			GroupIDs:   s.FirewallIDs,
+			Off:        s.Status == "off",
+			Resources:  &cloud.Resources{InstanceID: s.ID},
+		})
+	}
+	for _, fw := range firewalls {
+		sw.groups = append(sw.groups, sweptGroup{ID: fw.ID, Name: fw.Name, Created: fw.Created})
+	}
+	return sw
+}
+
+// staleResources returns what to tear down for a stale instance: the
+// instance itself and, going by its name, the auth key parameter and
+// instance profile it may have been launched with.
+func staleResources(provider *mayaws.Provider, inst mayaws.TaggedInstance) *cloud.Resources {
+	res := &cloud.Resources{InstanceID: inst.ID}
+	if strings.HasPrefix(inst.Name, "mayfly-") {
+		res.AuthKeyParameter = provider.AuthKeyParameter(inst.Name)
+		res.InstanceProfile = mayaws.InstanceProfileName(inst.Name)
+	}
+	return res
+}
+
+// instanceExpired reports whether an instance has powered itself off, or
+// outlived its deadline tag or, without one, the longest a node may live.
+func instanceExpired(inst sweptInstance, now time.Time) bool {
+	switch {
+	case inst.Off:
+		return true
+	case inst.Deadline.IsZero():
+		return now.Sub(inst.LaunchTime) >= untaggedMaxAge
+	}
+	return !inst.Deadline.After(now)
+}
+
+// unclaimedAuthKeys returns the auth key parameters or instance profiles
+// created for a node no instance carries the name of, once they are past
+// the grace period.
+func unclaimedAuthKeys(keys []sweptAuthKey, instanceNames map[string]bool, now time.Time) []sweptAuthKey {
+	var stale []sweptAuthKey
+	for _, key := range keys {
+		if !instanceNames[key.Node] && now.Sub(key.Created) >= groupGracePeriod {
+			stale = append(stale, key)
+		}
+	}
+	return stale
+}
@@ -0,0 +1,47 @@
+package runner
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestInstanceExpired(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		inst sweptInstance
+		want bool
+	}{
+		{"deadline ahead", sweptInstance{Deadline: now.Add(time.Minute), LaunchTime: now.Add(-24 * time.Hour)}, false},
+		{"deadline passed", sweptInstance{Deadline: now.Add(-time.Minute), LaunchTime: now.Add(-time.Hour)}, true},
+		{"untagged and new", sweptInstance{LaunchTime: now.Add(-time.Hour)}, false},
+		{"untagged and old", sweptInstance{LaunchTime: now.Add(-untaggedMaxAge)}, true},
+		{"powered off", sweptInstance{Deadline: now.Add(time.Hour), LaunchTime: now.Add(-time.Hour), Off: true}, true},
+	}
+	for _, tt := range tests {
+		if got := instanceExpired(tt.inst, now); got != tt.want {
+			t.Errorf("%s: instanceExpired = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUnclaimedAuthKeys(t *testing.T) {
+	now := time.Now()
+	keys := []sweptAuthKey{
+		{Name: "/mayfly/mayfly-a/auth-key", Node: "mayfly-a", Created: now.Add(-time.Hour)},
+		{Name: "/mayfly/mayfly-b/auth-key", Node: "mayfly-b", Created: now.Add(-time.Hour)},
+		{Name: "/mayfly/mayfly-c/auth-key", Node: "mayfly-c", Created: now.Add(-time.Minute)},
+		{Name: "/mayfly/stray", Created: now.Add(-time.Hour)},
+	}
+	// mayfly-a's instance is still around, and mayfly-c's `up` may not have
+	// launched it yet.
+	got := unclaimedAuthKeys(keys, map[string]bool{"mayfly-a": true}, now)
+	var names []string
+	for _, key := range got {
+		names = append(names, key.Name)
+	}
+	if want := []string{"/mayfly/mayfly-b/auth-key", "/mayfly/stray"}; !slices.Equal(names, want) {
+		t.Errorf("unclaimedAuthKeys = %v, want %v", names, want)
+	}
+}
@@ -0,0 +1,191 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"os/signal"
+	"syscall"
+	"time"
+
+	mayaws "github.com/jamesboyd/mayfly/internal/aws"
+	"github.com/jamesboyd/mayfly/internal/cloud"
+	"github.com/jamesboyd/mayfly/internal/config"
+	"github.com/jamesboyd/mayfly/internal/display"
+	"github.com/jamesboyd/mayfly/internal/userdata"
+)
+
+// How long the builder may take to install and power off, and how long AWS
+// may take to turn its volume into an AMI.
+const (
+	builderTimeout = 20 * time.Minute
+	imageTimeout   = 30 * time.Minute
+)
+
+// BuildImage launches a builder instance from the latest release of cfg.Image,
+// which installs the pinned Tailscale version, enables forwarding, hardens
+// itself and powers off. The stopped builder is snapshotted into a private
+// AMI that LookupImage then prefers for that OS and architecture, and is
+// terminated whether or not the build succeeds.
+func BuildImage(ctx context.Context, cfg *config.Config) error {
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	display.Status("Loading AWS configuration...")
+	provider, err := mayaws.New(ctx, cfg.Region, mayaws.WithNetwork(awsNetwork(cfg)))
+	if err != nil {
+		return err
+	}
+
+	instanceType, err := resolveInstanceType(ctx, provider, cfg)
+	if err != nil {
+		return err
+	}
+
+	display.Status(fmt.Sprintf("Looking up latest %s image...", cfg.Image))
+	baseID, err := provider.LookupReleaseImage(ctx, cfg.Image, instanceType)
+	if err != nil {
+		return err
+	}
+	display.Success(fmt.Sprintf("Base image: %s", baseID))
+
+	ud, err := userdata.GenerateImage(userdata.ImageParams{
+		OS:               cfg.Image,
+		TailscaleVersion: cfg.TailscaleVersion,
+	})
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("mayfly-image-%s-%s", cfg.Image, time.Now().UTC().Format("20060102-150405"))
+	display.Status(fmt.Sprintf("Launching builder %s (%s)...", name, instanceType))
+	res, err := provider.LaunchBuilder(ctx, cloud.Spec{
+		Name:         name,
+		ImageID:      baseID,
+		InstanceType: instanceType,
+		UserData:     ud,
+		// Lets `mayfly gc` sweep a builder this process never got to clean up.
+		Deadline: time.Now().Add(builderTimeout + imageTimeout),
+	})
+	defer func() {
+		display.Status("Terminating builder...")
+		if err := provider.Teardown(context.Background(), res); err != nil {
+			display.Error(fmt.Sprintf("Cloud teardown error: %v", err))
+		} else {
+			display.Success("Builder terminated and security group deleted")
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	display.Success(fmt.Sprintf("Builder running (%s)", res.InstanceID))
+
+	display.Status(fmt.Sprintf("Installing Tailscale %s and hardening; the builder powers off when done...", cfg.TailscaleVersion))
+	if err := provider.WaitStopped(ctx, res.InstanceID, builderTimeout); err != nil {
+		return fmt.Errorf("%w (if the builder script failed, its console output shows why)", err)
+	}
+	// The script powers off when a step fails too, so check it got to the end.
+	output, err := provider.ConsoleOutput(ctx, res.InstanceID)
+	if err != nil {
+		return fmt.Errorf("checking the builder's console for failures: %w", err)
+	}
+	if failure := userdata.ParseProgress(output).Failure; failure != "" {
+		return fmt.Errorf("builder script failed at %s; its console output shows why", failure)
+	}
+
+	display.Status("Creating AMI...")
+	imageID, err := provider.CreateImage(ctx, res.InstanceID, name, cfg.Image, cfg.TailscaleVersion, imageTimeout)
+	if err != nil {
+		if imageID != "" {
+			// The snapshot outlives the builder, so the AMI may still become
+			// available; if it fails instead, prune deletes it.
+			display.Warn(fmt.Sprintf("Image %s was not available yet; once it is, it is used like any other, and if it fails, `mayfly image prune` deletes it", imageID))
+		}
+		return err
+	}
+
+	display.Success(fmt.Sprintf("Built %s", imageID))
+	display.Info("Name:", name)
+	display.Info("OS:", cfg.Image)
+	display.Info("Tailscale:", cfg.TailscaleVersion)
+	display.Info("Region:", cfg.Region)
+	return nil
+}
+
+// PruneImages deregisters all but the newest keep mayfly-built AMIs of each
+// OS and architecture in the region, and deletes their snapshots. It prints
+// the plan and, unless dryRun is set, deletes them after confirmation.
+func PruneImages(ctx context.Context, cfg *config.Config, keep int, dryRun bool) error {
+	display.Status("Loading AWS configuration...")
+	provider, err := mayaws.New(ctx, cfg.Region)
+	if err != nil {
+		return err
+	}
+
+	images, err := provider.ListImages(ctx)
+	if err != nil {
+		return err
+	}
+
+	stale := staleImages(images, keep)
+	if len(stale) == 0 {
+		display.Success(fmt.Sprintf("No old mayfly images in %s (%d kept)", cfg.Region, len(images)))
+		return nil
+	}
+
+	display.Warn(fmt.Sprintf("Found %d old images:", len(stale)))
+	for _, img := range stale {
+		display.Info(img.ID, fmt.Sprintf("%s (%s %s, Tailscale %s, created %s, %d snapshots)",
+			img.Name, img.OS, img.Architecture, valueOr(img.TailscaleVersion, "unknown"),
+			img.Created.Format(time.RFC3339), len(img.SnapshotIDs)))
+	}
+
+	if dryRun {
+		display.Status("Dry run — nothing deleted")
+		return nil
+	}
+	if !display.Confirm("Deregister these images and delete their snapshots?") {
+		display.Status("Aborted — nothing deleted")
+		return nil
+	}
+
+	var failed int
+	for _, img := range stale {
+		if err := provider.DeleteImage(context.Background(), img); err != nil {
+			display.Warn(fmt.Sprintf("Failed to delete %s: %v", img.ID, err))
+			failed++
+			continue
+		}
+		display.Success(fmt.Sprintf("Deleted %s", img.ID))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d images could not be deleted", failed)
+	}
+	display.Success("Old images cleaned up")
+	return nil
+}
+
+// staleImages returns the images beyond the newest keep available ones of
+// each OS and architecture, plus any that failed to build. Pending images
+// are left alone, since a build may still be creating them. images must be
+// sorted newest first.
+func staleImages(images []mayaws.Image, keep int) []mayaws.Image {
+	seen := map[string]int{}
+	var stale []mayaws.Image
+	for _, img := range images {
+		switch img.State {
+		case "pending":
+			continue
+		case "available":
+		default:
+			stale = append(stale, img)
+			continue
+		}
+		key := img.OS + "/" + img.Architecture
+		seen[key]++
+		if seen[key] > keep {
+			stale = append(stale, img)
+		}
+	}
+	return stale
+}
@@ -0,0 +1,39 @@
+package runner
+
+import (
+	"slices"
+	"testing"
+
+	mayaws "github.com/jamesboyd/mayfly/internal/aws"
+)
+
+func TestStaleImages(t *testing.T) {
+	// Newest first, as ListImages returns them.
+	images := []mayaws.Image{
+		{ID: "ami-al-arm-4", OS: "al2023", Architecture: "arm64", State: "pending"},
+		{ID: "ami-al-arm-3", OS: "al2023", Architecture: "arm64", State: "available"},
+		{ID: "ami-deb-arm-2", OS: "debian-12", Architecture: "arm64", State: "available"},
+		{ID: "ami-al-x86-2", OS: "al2023", Architecture: "x86_64", State: "available"},
+		{ID: "ami-al-arm-f", OS: "al2023", Architecture: "arm64", State: "failed"},
+		{ID: "ami-al-arm-2", OS: "al2023", Architecture: "arm64", State: "available"},
+		{ID: "ami-al-arm-1", OS: "al2023", Architecture: "arm64", State: "available"},
+	}
+
+	ids := func(images []mayaws.Image) []string {
+		var ids []string
+		for _, img := range images {
+			ids = append(ids, img.ID)
+		}
+		return ids
+	}
+
+	if got, want := ids(staleImages(images, 1)), []string{"ami-al-arm-f", "ami-al-arm-2", "ami-al-arm-1"}; !slices.Equal(got, want) {
+		t.Errorf("staleImages(keep 1) = %v, want %v", got, want)
+	}
+	if got, want := ids(staleImages(images, 2)), []string{"ami-al-arm-f", "ami-al-arm-1"}; !slices.Equal(got, want) {
+		t.Errorf("staleImages(keep 2) = %v, want %v", got, want)
+	}
+	if got := staleImages(images, 0); len(got) != len(images)-1 {
+		t.Errorf("staleImages(keep 0) = %v, want every image but the pending one", ids(got))
+	}
+}
@@ -0,0 +1,439 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jamesboyd/mayfly/internal/cloud"
+	"github.com/jamesboyd/mayfly/internal/config"
+	"github.com/jamesboyd/mayfly/internal/control"
+	"github.com/jamesboyd/mayfly/internal/display"
+	"github.com/jamesboyd/mayfly/internal/state"
+)
+
+// resolveNode finds the recorded node whose name or instance ID matches key.
+// An empty key selects the only recorded node. Returns nil if nothing is recorded.
+func resolveNode(key string) (*state.State, error) {
+	nodes, err := state.List()
+	if err != nil {
+		return nil, fmt.Errorf("reading state files: %w", err)
+	}
+
+	if key == "" {
+		switch len(nodes) {
+		case 0:
+			return nil, nil
+		case 1:
+			return nodes[0], nil
+		}
+		names := make([]string, len(nodes))
+		for i, n := range nodes {
+			names[i] = n.Name
+		}
+		return nil, fmt.Errorf("multiple nodes running (%s) — specify one", strings.Join(names, ", "))
+	}
+
+	for _, n := range nodes {
+		if n.Name == key || n.InstanceID == key {
+			return n, nil
+		}
+	}
+	return nil, fmt.Errorf("no node named %q", key)
+}
+
+// Down tears down the node matching key. If a live mayfly process owns the
+// node, it is signalled to run its own teardown instead, so the two never
+// tear down the same node concurrently.
+func Down(ctx context.Context, cfg *config.Config, key string) error {
+	s, err := resolveNode(key)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		display.Warn("No running node found")
+		return nil
+	}
+
+	if pid := liveOwner(s.Name); pid != 0 {
+		display.Status(fmt.Sprintf("Signalling mayfly process (PID %d) to tear down %s...", pid, s.Name))
+		proc, err := os.FindProcess(pid)
+		if err != nil {
+			return fmt.Errorf("finding mayfly process %d: %w", pid, err)
+		}
+		if err := proc.Signal(syscall.SIGTERM); err != nil {
+			return fmt.Errorf("signalling mayfly process %d: %w", pid, err)
+		}
+		if err := waitForExit(ctx, pid); err != nil {
+			return err
+		}
+		display.Success("All resources cleaned up")
+		return nil
+	}
+
+	// Claim the node so a concurrent `down` or `up` defers to us.
+	if err := state.SavePID(s.Name); err != nil {
+		display.Warn(fmt.Sprintf("Could not write pidfile: %v", err))
+	}
+	defer state.ClearPID(s.Name)
+
+	display.Info("Node:", s.Name)
+	display.Info("Instance ID:", s.InstanceID)
+	display.Info("Security Group:", s.SecurityGroupID)
+	display.Info("Region:", s.Region)
+
+	if err := teardownRecorded(ctx, s, cfg); err != nil {
+		return err
+	}
+	display.Success("All resources cleaned up")
+	return nil
+}
+
+// Supervise watches the named node until its deadline or a termination
+// signal, then tears it down. It is the body of the background process
+// started by `mayfly up --detach`.
+func Supervise(ctx context.Context, cfg *config.Config, name string) error {
+	s, err := state.Load(name)
+	if err != nil {
+		return fmt.Errorf("reading state file: %w", err)
+	}
+	if s == nil {
+		return fmt.Errorf("no node named %q to supervise", name)
+	}
+
+	// Claiming the pidfile tells `up --detach` the handoff worked, so only do
+	// it once the supervisor has what it needs to tear the node down.
+	provider, err := newProvider(ctx, cfg, s.Provider, s.Region)
+	if err != nil {
+		return err
+	}
+
+	if err := state.SavePID(name); err != nil {
+		return fmt.Errorf("writing pidfile: %w", err)
+	}
+	defer state.ClearPID(name)
+
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	display.Status(fmt.Sprintf("Supervising %s (%s) until %s", s.Name, s.InstanceID, s.Deadline.Format(time.RFC3339)))
+
+	timer := time.NewTimer(time.Until(s.Deadline))
+	defer timer.Stop()
+	extend := watchDeadline(ctx, name, s.Deadline)
+	gone := watchInstance(ctx, provider, s.InstanceID)
+
+wait:
+	for {
+		select {
+		case <-ctx.Done():
+			display.Warn("Interrupted — tearing down...")
+			break wait
+		case d := <-extend:
+			display.Status(fmt.Sprintf("TTL extended until %s", d.Format(time.RFC3339)))
+			timer.Reset(time.Until(d))
+		case <-timer.C:
+			display.Status("TTL expired — tearing down...")
+			break wait
+		case <-gone:
+			display.Warn("Instance was reclaimed (spot interruption?) — tearing down...")
+			break wait
+		}
+	}
+
+	if err := teardownRecorded(context.Background(), s, cfg); err != nil {
+		return err
+	}
+	display.Success("All resources cleaned up")
+	return nil
+}
+
+// Extend pushes out the deadline of the node matching key. It updates the
+// instance's deadline tag first, so its self-destruct timer never fires
+// before the new deadline, then the state file, which the process managing
+// the node watches. The total lifetime may not exceed the max lifetime the
+// node was launched with.
+func Extend(ctx context.Context, cfg *config.Config, key string, by time.Duration) error {
+	s, err := resolveNode(key)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return fmt.Errorf("no running node found")
+	}
+	if s.Deadline.IsZero() {
+		return fmt.Errorf("node %s has no recorded deadline", s.Name)
+	}
+
+	provider, err := newProvider(ctx, cfg, s.Provider, s.Region)
+	if err != nil {
+		return err
+	}
+
+	launchedAt := s.LaunchedAt
+	if launchedAt.IsZero() {
+		inst, err := provider.Describe(ctx, s.InstanceID)
+		if err != nil {
+			return err
+		}
+		launchedAt = inst.LaunchTime
+	}
+
+	// Extending an already-expired node counts from now.
+	base := s.Deadline
+	if now := time.Now(); base.Before(now) {
+		base = now
+	}
+	deadline := base.Add(by)
+
+	maxLifetime := s.MaxLifetime
+	if maxLifetime <= 0 {
+		maxLifetime = config.DefaultMaxLifetime
+	}
+	if limit := launchedAt.Add(maxLifetime); deadline.After(limit) {
+		return fmt.Errorf("extending by %s would exceed the max lifetime of %s (latest allowed deadline %s)",
+			by, maxLifetime, limit.Format(time.RFC3339))
+	}
+
+	if err := provider.SetDeadline(ctx, s.InstanceID, deadline); err != nil {
+		return err
+	}
+
+	s.LaunchedAt = launchedAt
+	s.Deadline = deadline
+	if err := state.Save(s); err != nil {
+		return fmt.Errorf("saving state file: %w", err)
+	}
+
+	display.Success(fmt.Sprintf("Extended %s until %s (%s remaining)",
+		s.Name, deadline.Format(time.RFC3339), time.Until(deadline).Truncate(time.Second)))
+	if liveOwner(s.Name) == 0 {
+		display.Warn("No mayfly process is managing this node — only the instance's own timer will enforce the new deadline")
+	}
+	return nil
+}
+
+// watchDeadline polls the node's state file and sends each new deadline
+// written by `mayfly extend`. The channel is never closed.
+func watchDeadline(ctx context.Context, name string, deadline time.Time) <-chan time.Time {
+	ch := make(chan time.Time)
+
+	go func() {
+		ticker := time.NewTicker(deadlinePollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			s, err := state.Load(name)
+			if err != nil || s == nil || !s.Deadline.After(deadline) {
+				continue
+			}
+			deadline = s.Deadline
+
+			select {
+			case ch <- deadline:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+// watchInstance polls the node's instance and closes the returned channel
+// once the cloud reports it gone, e.g. after a spot interruption, so the
+// node is torn down now rather than at its deadline. Errors describing the
+// instance are assumed to be transient.
+func watchInstance(ctx context.Context, provider cloud.Provider, instanceID string) <-chan struct{} {
+	gone := make(chan struct{})
+	ticker := time.NewTicker(instancePollInterval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if inst, err := provider.Describe(ctx, instanceID); err == nil && inst.Gone {
+				close(gone)
+				return
+			}
+		}
+	}()
+
+	return gone
+}
+
+// isClosed reports whether ch has been closed, without blocking.
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// Status prints the live details of the node matching key, or of every
+// recorded node if key is empty.
+func Status(ctx context.Context, cfg *config.Config, key string) error {
+	var nodes []*state.State
+	if key == "" {
+		all, err := state.List()
+		if err != nil {
+			return fmt.Errorf("reading state files: %w", err)
+		}
+		nodes = all
+	} else {
+		s, err := resolveNode(key)
+		if err != nil {
+			return err
+		}
+		nodes = []*state.State{s}
+	}
+
+	if len(nodes) == 0 {
+		display.Warn("No running node found")
+		return nil
+	}
+
+	tsClient := newControl(cfg)
+	for i, s := range nodes {
+		if i > 0 {
+			fmt.Println()
+		}
+		if err := printStatus(ctx, cfg, tsClient, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printStatus(ctx context.Context, cfg *config.Config, tsClient control.Plane, s *state.State) error {
+	display.Status(s.Name)
+	display.Info("Region:", s.Region)
+	display.Info("Instance ID:", s.InstanceID)
+
+	provider, err := newProvider(ctx, cfg, s.Provider, s.Region)
+	if err != nil {
+		return err
+	}
+
+	if inst, err := provider.Describe(ctx, s.InstanceID); err != nil {
+		display.Warn(fmt.Sprintf("Could not describe instance: %v", err))
+	} else {
+		display.Info("Instance state:", inst.State)
+		display.Info("Public IP:", valueOr(inst.PublicIP, "none"))
+	}
+
+	if dev, err := nodeDevice(ctx, tsClient, s); errors.Is(err, control.ErrAmbiguous) {
+		display.Warn(err.Error())
+	} else if err != nil {
+		display.Info("Tailnet device:", "not joined")
+	} else {
+		online := "no"
+		if dev.Online() {
+			online = "yes"
+		}
+		display.Info("Tailnet device:", dev.ID)
+		display.Info("Online:", online)
+	}
+
+	switch remaining := time.Until(s.Deadline).Truncate(time.Second); {
+	case s.Deadline.IsZero():
+		display.Info("Time remaining:", "unknown")
+	case remaining <= 0:
+		display.Info("Time remaining:", "expired")
+	default:
+		display.Info("Time remaining:", remaining.String())
+	}
+
+	if pid := liveOwner(s.Name); pid != 0 {
+		display.Info("Managed by:", fmt.Sprintf("PID %d", pid))
+	} else {
+		display.Warn(fmt.Sprintf("No mayfly process is managing this node — run `mayfly down %s` to tear it down", s.Name))
+	}
+	return nil
+}
+
+func valueOr(v, fallback string) string {
+	if v == "" {
+		return fallback
+	}
+	return v
+}
+
+// teardownRecorded tears down the resources described by a state record.
+func teardownRecorded(ctx context.Context, s *state.State, cfg *config.Config) error {
+	provider, err := newProvider(ctx, cfg, s.Provider, s.Region)
+	if err != nil {
+		return err
+	}
+
+	res := &cloud.Resources{
+		InstanceID:       s.InstanceID,
+		SecurityGroupID:  s.SecurityGroupID,
+		AuthKeyParameter: s.AuthKeyParameter,
+		InstanceProfile:  s.InstanceProfile,
+	}
+
+	teardown(provider, res, cfg, s.Name)
+	return nil
+}
+
+// liveOwner returns the PID of another running mayfly process that owns the
+// named node, or 0 if there is none. A pidfile whose PID now belongs to some
+// unrelated process doesn't count: the owner must still hold the node's lock.
+func liveOwner(name string) int {
+	pid, err := state.Owner(name)
+	if err != nil || pid == 0 || pid == os.Getpid() {
+		return 0
+	}
+	if !processAlive(pid) {
+		return 0
+	}
+	return pid
+}
+
+func processAlive(pid int) bool {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return proc.Signal(syscall.Signal(0)) == nil
+}
+
+// waitForExit polls until the process exits. Teardown waits up to 5 minutes
+// for instance termination, so allow a little longer than that.
+func waitForExit(ctx context.Context, pid int) error {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	timeout := time.After(10 * time.Minute)
+
+	for processAlive(pid) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			return fmt.Errorf("timed out waiting for mayfly process %d to finish teardown", pid)
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
@@ -2,189 +2,504 @@ package runner
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	awsconfig "github.com/aws/aws-sdk-go-v2/config"
-
 	mayaws "github.com/jamesboyd/mayfly/internal/aws"
+	"github.com/jamesboyd/mayfly/internal/cloud"
 	"github.com/jamesboyd/mayfly/internal/config"
+	"github.com/jamesboyd/mayfly/internal/control"
 	"github.com/jamesboyd/mayfly/internal/display"
+	"github.com/jamesboyd/mayfly/internal/headscale"
+	"github.com/jamesboyd/mayfly/internal/hetzner"
 	"github.com/jamesboyd/mayfly/internal/state"
 	"github.com/jamesboyd/mayfly/internal/tailscale"
 	"github.com/jamesboyd/mayfly/internal/userdata"
 )
 
+// newProvider returns the named cloud provider for a region. Tests replace it.
+var newProvider = func(ctx context.Context, cfg *config.Config, provider, region string) (cloud.Provider, error) {
+	if provider == config.ProviderHetzner {
+		return hetzner.New(cfg.HetznerToken, region)
+	}
+	return mayaws.New(ctx, region, mayaws.WithNetwork(awsNetwork(cfg)))
+}
+
+func awsNetwork(cfg *config.Config) mayaws.Network {
+	return mayaws.Network{
+		VPCID:     cfg.VPCID,
+		SubnetID:  cfg.SubnetID,
+		SubnetTag: cfg.SubnetTag,
+	}
+}
+
+// newControl returns the client for the configured control server. Tests replace it.
+var newControl = func(cfg *config.Config) control.Plane {
+	if cfg.Control == config.ControlHeadscale {
+		return headscale.NewClient(cfg.HeadscaleURL, cfg.HeadscaleAPIKey, cfg.HeadscaleUser)
+	}
+	return tailscale.NewClient(tailscaleCredentials(cfg), cfg.TailscaleTailnet)
+}
+
+func tailscaleCredentials(cfg *config.Config) tailscale.Credentials {
+	return tailscale.Credentials{
+		APIKey:            cfg.TailscaleAPIKey,
+		OAuthClientID:     cfg.TailscaleOAuthClientID,
+		OAuthClientSecret: cfg.TailscaleOAuthClientSecret,
+	}
+}
+
+// authKeyExpiry is how long a generated pre-auth key stays valid. It only
+// has to outlast instance boot.
+const authKeyExpiry = 15 * time.Minute
+
+// How often and for how long to poll for the device joining the tailnet.
+var (
+	devicePollInterval = 5 * time.Second
+	deviceJoinTimeout  = 3 * time.Minute
+)
+
+// instancePollInterval is how often a running node's instance is checked for
+// having been reclaimed, e.g. by a spot interruption. Tests shorten it.
+var instancePollInterval = 15 * time.Second
+
+// deadlinePollInterval is how often a node's state file is checked for a
+// deadline pushed out by `mayfly extend`. Tests shorten it.
+var deadlinePollInterval = 2 * time.Second
+
 func Run(ctx context.Context, cfg *config.Config) error {
 	// Check for orphaned resources from a previous crash.
 	if err := cleanupOrphans(ctx, cfg); err != nil {
 		return err
 	}
 
+	// Read extra user-data parts up front, so a bad file fails before launch.
+	var extraParts []userdata.Part
+	for _, path := range cfg.UserDataAppend {
+		part, err := userdata.ReadPart(path)
+		if err != nil {
+			return err
+		}
+		extraParts = append(extraParts, part)
+	}
+
+	// The node name doubles as the tailnet hostname and keys the state file.
+	name := state.NewName(cfg.Region)
+
+	// Record our PID so `mayfly down` can ask us to tear down.
+	if err := state.SavePID(name); err != nil {
+		display.Warn(fmt.Sprintf("Could not write pidfile: %v", err))
+	}
+	defer state.ClearPID(name)
+
 	// Set up signal handling — Ctrl+C triggers graceful teardown.
 	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	// --- Load AWS config ---
-	display.Status("Loading AWS configuration...")
-	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(cfg.Region))
+	// --- Load provider config ---
+	display.Status(fmt.Sprintf("Loading %s configuration...", providerName(cfg.Provider)))
+	provider, err := newProvider(ctx, cfg, cfg.Provider, cfg.Region)
+	if err != nil {
+		return err
+	}
+
+	instanceType, err := resolveInstanceType(ctx, provider, cfg)
 	if err != nil {
-		return fmt.Errorf("loading AWS config: %w", err)
+		return err
 	}
 
-	// --- Lookup AMI ---
-	display.Status("Looking up latest Amazon Linux 2023 AMI...")
-	amiID, err := mayaws.LookupAMI(ctx, awsCfg)
+	// --- Lookup image ---
+	display.Status("Looking up latest image...")
+	imageID, err := provider.LookupImage(ctx, cfg.Image, instanceType)
 	if err != nil {
 		return err
 	}
-	display.Success(fmt.Sprintf("AMI: %s", amiID))
+	display.Success(fmt.Sprintf("Image: %s (%s)", imageID, cfg.OS()))
+
+	// The TTL runs from launch, so the instance's own self-destruct timer and
+	// our countdown agree on the deadline.
+	launchedAt := time.Now()
+	deadline := launchedAt.Add(cfg.TTL)
 
 	// --- Generate user-data ---
-	ud := userdata.Generate(cfg.TailscaleAuthKey)
+	// A pre-auth key is single-use, so check the user-data fits with a
+	// placeholder as long as any key before minting the real one.
+	params := userdata.Params{
+		OS:               cfg.OS(),
+		AuthKey:          authKeyPlaceholder,
+		Hostname:         name,
+		LoginServer:      cfg.LoginServer(),
+		Tags:             cfg.Tags,
+		Deadline:         deadline,
+		TailscaleVersion: cfg.TailscaleVersion,
+		Append:           extraParts,
+		EC2Metadata:      cfg.Provider != config.ProviderHetzner,
+	}
+	// Where the provider can hand the key over out of band, the user-data
+	// only says where to fetch it from.
+	if store, ok := provider.(cloud.SecretStore); ok {
+		params.AuthKey = ""
+		params.AuthKeyParameter = store.AuthKeyParameter(name)
+		params.Region = cfg.Region
+	}
+	if _, err := renderUserData(provider, cfg, params); err != nil {
+		return err
+	}
+
+	// --- Pre-auth key ---
+	authKey, err := resolveAuthKey(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if params.AuthKey != "" {
+		params.AuthKey = authKey
+		display.Warn(fmt.Sprintf("%s has no secret store, so the single-use auth key is readable from the server's user-data until it is used or expires", providerName(cfg.Provider)))
+	}
+	ud, err := renderUserData(provider, cfg, params)
+	if err != nil {
+		return err
+	}
+
+	// --- Check exit node auto-approval ---
+	autoApproved := cfg.CheckPolicy && checkAutoApproval(ctx, cfg)
 
 	// --- Provision ---
-	display.Status("Provisioning EC2 instance...")
-	res, err := mayaws.Provision(ctx, awsCfg, amiID, cfg.InstanceType, ud)
+	display.Status(fmt.Sprintf("Provisioning instance %s...", name))
+	res, err := provider.Provision(ctx, cloud.Spec{
+		Name:         name,
+		ImageID:      imageID,
+		InstanceType: instanceType,
+		UserData:     ud,
+		Deadline:     deadline,
+		Spot:         cfg.Spot,
+		SpotMaxPrice: cfg.SpotMaxPrice,
+		AuthKey:      authKey,
+	})
 
 	// Save state immediately so we can recover if we crash after this point.
-	saveState(cfg, res)
+	saveState(name, cfg, res, launchedAt, deadline)
 
 	if err != nil {
 		display.Error(fmt.Sprintf("Provisioning failed: %v", err))
 		display.Status("Cleaning up partial resources...")
-		teardown(awsCfg, res, cfg)
+		teardown(provider, res, cfg, name)
 		return err
 	}
 
 	display.Success("Instance running")
+	if cfg.Spot && !res.Spot {
+		display.Warn("No spot capacity available — running on-demand instead")
+	}
+	display.Info("Node:", name)
 	display.Info("Instance ID:", res.InstanceID)
+	display.Info("Tailnet hostname:", control.Hostname(name, res.InstanceID))
 	display.Info("Public IP:", res.PublicIP)
 	display.Info("Security Group:", res.SecurityGroupID)
+	display.Info("Instance Type:", instanceType)
+	display.Info("Provider:", providerName(cfg.Provider))
 	display.Info("Region:", cfg.Region)
 	display.Info("TTL:", cfg.TTL.String())
+	if res.Spot {
+		display.Info("Capacity:", "spot")
+	}
+	if cfg.Provider == config.ProviderHetzner {
+		display.Warn("At its deadline the server only powers itself off, and a powered-off server is still billed until mayfly up, down or gc --hcloud-token deletes it")
+	}
 
 	// --- Wait for device to join tailnet and approve exit node ---
 	display.Status("Waiting for device to join tailnet...")
-	tsClient := tailscale.NewClient(cfg.TailscaleAPIKey, cfg.TailscaleTailnet)
-	if deviceID, err := waitForDevice(ctx, tsClient, userdata.Hostname()); err != nil {
+	tsClient := newControl(cfg)
+	if deviceID, err := waitForDevice(ctx, tsClient, name, res.InstanceID, newBootReporter(provider, res.InstanceID)); err != nil {
 		display.Warn(fmt.Sprintf("Could not find device in tailnet: %v", err))
 	} else {
 		display.Success(fmt.Sprintf("Device joined tailnet (ID: %s)", deviceID))
-		display.Status("Approving exit node routes...")
-		if err := tsClient.ApproveExitNode(ctx, deviceID); err != nil {
-			display.Warn(fmt.Sprintf("Could not approve exit node: %v", err))
+		recordDevice(name, deviceID)
+		if autoApproved {
+			display.Success("Exit node auto-approved by tailnet policy")
 		} else {
-			display.Success("Exit node approved")
+			display.Status("Approving exit node routes...")
+			if err := tsClient.ApproveExitNode(ctx, deviceID); err != nil {
+				display.Warn(fmt.Sprintf("Could not approve exit node: %v", err))
+			} else {
+				display.Success("Exit node approved")
+			}
 		}
 	}
 
 	fmt.Println()
 
 	// --- Countdown ---
-	deadline := time.Now().Add(cfg.TTL)
+	if cfg.Detach {
+		pid, logPath, err := detach(cfg, name)
+		if err == nil {
+			display.Success(fmt.Sprintf("Handed off to background supervisor (PID %d)", pid))
+			display.Info("Log:", logPath)
+			display.Info("Expires:", deadline.Format(time.RFC3339))
+			return nil
+		}
+		display.Warn(fmt.Sprintf("Could not start background supervisor, staying in foreground: %v", err))
+	}
+
 	done := make(chan struct{})
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	gone := watchInstance(watchCtx, provider, res.InstanceID)
 
 	go func() {
-		<-ctx.Done()
+		select {
+		case <-watchCtx.Done():
+		case <-gone:
+		}
 		close(done)
 	}()
 
-	display.Countdown(deadline, done)
+	display.Countdown(deadline, watchDeadline(ctx, name, deadline), done)
+	stopWatch()
 
 	// --- Teardown ---
-	if ctx.Err() != nil {
+	switch {
+	case ctx.Err() != nil:
 		fmt.Println()
 		display.Warn("Interrupted — tearing down...")
-	} else {
+	case isClosed(gone):
+		fmt.Println()
+		display.Warn("Instance was reclaimed (spot interruption?) — tearing down...")
+	default:
 		display.Status("TTL expired — tearing down...")
 	}
 
-	teardown(awsCfg, res, cfg)
+	teardown(provider, res, cfg, name)
 	display.Success("All resources cleaned up")
 	return nil
 }
 
+// cleanupOrphans tears down recorded nodes that no live mayfly process is
+// managing. Nodes owned by another running `up` or supervisor are left alone.
 func cleanupOrphans(ctx context.Context, cfg *config.Config) error {
-	prev, err := state.Load()
+	nodes, err := state.List()
 	if err != nil {
-		display.Warn(fmt.Sprintf("Could not read state file: %v", err))
+		display.Warn(fmt.Sprintf("Could not read state files: %v", err))
 		return nil
 	}
-	if prev == nil {
-		return nil
+
+	for _, prev := range nodes {
+		if liveOwner(prev.Name) != 0 {
+			continue
+		}
+
+		display.Warn(fmt.Sprintf("Found orphaned node %s from a previous run", prev.Name))
+		display.Info("Instance ID:", prev.InstanceID)
+		display.Info("Security Group:", prev.SecurityGroupID)
+		display.Info("Region:", prev.Region)
+		display.Status("Cleaning up orphaned resources...")
+
+		if err := teardownRecorded(ctx, prev, cfg); err != nil {
+			return fmt.Errorf("orphan cleanup: %w", err)
+		}
+		display.Success("Orphaned resources cleaned up")
+		fmt.Println()
+	}
+	return nil
+}
+
+// providerName returns a display name for a provider; empty means AWS.
+func providerName(provider string) string {
+	if provider == config.ProviderHetzner {
+		return "Hetzner Cloud"
 	}
+	return "AWS"
+}
 
-	display.Warn("Found orphaned resources from a previous run")
-	display.Info("Instance ID:", prev.InstanceID)
-	display.Info("Security Group:", prev.SecurityGroupID)
-	display.Info("Region:", prev.Region)
-	display.Status("Cleaning up orphaned resources...")
+// resolveInstanceType returns the configured instance type, or asks the
+// provider for the cheapest default its region offers when none was given.
+func resolveInstanceType(ctx context.Context, provider cloud.Provider, cfg *config.Config) (string, error) {
+	if cfg.InstanceType != "" {
+		return cfg.InstanceType, nil
+	}
 
-	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(prev.Region))
+	chooser, ok := provider.(cloud.InstanceTypeChooser)
+	if !ok {
+		return "", fmt.Errorf("no instance type given and %s has no default", providerName(cfg.Provider))
+	}
+	return chooser.DefaultInstanceType(ctx)
+}
+
+// authKeyPlaceholder stands in for the auth key while checking the user-data's
+// size: no key userdata accepts is longer.
+var authKeyPlaceholder = strings.Repeat("x", 128)
+
+// renderUserData returns the base64-encoded user-data for p, checking that
+// the provider accepts that much.
+func renderUserData(provider cloud.Provider, cfg *config.Config, p userdata.Params) (string, error) {
+	doc, err := userdata.Render(p)
 	if err != nil {
-		return fmt.Errorf("loading AWS config for orphan cleanup: %w", err)
+		return "", err
+	}
+	if limit := provider.MaxUserData(); len(doc) > limit {
+		return "", fmt.Errorf("user-data is %d bytes, over the %d bytes %s accepts", len(doc), limit, providerName(cfg.Provider))
 	}
+	return base64.StdEncoding.EncodeToString([]byte(doc)), nil
+}
 
-	res := &mayaws.Resources{
-		InstanceID:      prev.InstanceID,
-		SecurityGroupID: prev.SecurityGroupID,
+// resolveAuthKey returns the configured auth key, or creates one through the
+// control server's API when none was given.
+func resolveAuthKey(ctx context.Context, cfg *config.Config) (string, error) {
+	if cfg.TailscaleAuthKey != "" {
+		return cfg.TailscaleAuthKey, nil
 	}
 
-	teardown(awsCfg, res, cfg)
-	display.Success("Orphaned resources cleaned up")
-	fmt.Println()
-	return nil
+	creator, ok := newControl(cfg).(control.AuthKeyCreator)
+	if !ok {
+		return "", fmt.Errorf("no auth key given and the %s control server can't create one", cfg.Control)
+	}
+
+	display.Status("Creating pre-auth key...")
+	key, err := creator.CreateAuthKey(ctx, control.KeyRequest{Expiry: authKeyExpiry, Tags: cfg.Tags})
+	if err != nil {
+		return "", err
+	}
+	display.Success("Pre-auth key created")
+	return key, nil
+}
+
+// checkAutoApproval reports whether the tailnet policy's autoApprovers entry
+// covers the node's tags, so its exit node routes need no approval through
+// the API. Anything short of a yes is a warning, not an error.
+func checkAutoApproval(ctx context.Context, cfg *config.Config) bool {
+	display.Status("Checking tailnet policy for exit node auto-approval...")
+
+	reader, ok := newControl(cfg).(control.PolicyReader)
+	if !ok {
+		display.Warn(fmt.Sprintf("The %s control server's policy can't be checked", cfg.Control))
+		return false
+	}
+	if len(cfg.Tags) == 0 {
+		display.Warn("No --tags set, so the exit node can't be auto-approved by tag")
+		return false
+	}
+
+	policy, err := reader.Policy(ctx)
+	if err != nil {
+		display.Warn(fmt.Sprintf("Could not check tailnet policy: %v", err))
+		return false
+	}
+	approved, unchecked, err := control.ExitNodeAutoApproved(policy, cfg.Tags)
+	if err != nil {
+		display.Warn(fmt.Sprintf("Could not check tailnet policy: %v", err))
+		return false
+	}
+	switch {
+	case !approved && len(unchecked) > 0:
+		display.Warn(fmt.Sprintf("Tailnet policy autoApprovers.exitNode lists none of %s, and only tag approvers can be checked before launch (not %s) — the exit node will be approved through the API",
+			strings.Join(cfg.Tags, ", "), strings.Join(unchecked, ", ")))
+		return false
+	case !approved:
+		display.Warn(fmt.Sprintf("Tailnet policy autoApprovers.exitNode doesn't include any of %s — the exit node will need approval through the API", strings.Join(cfg.Tags, ", ")))
+		return false
+	}
+
+	display.Success("Tailnet policy auto-approves the exit node")
+	return true
 }
 
-func saveState(cfg *config.Config, res *mayaws.Resources) {
+func saveState(name string, cfg *config.Config, res *cloud.Resources, launchedAt, deadline time.Time) {
 	s := &state.State{
-		Region:          cfg.Region,
-		InstanceID:      res.InstanceID,
-		SecurityGroupID: res.SecurityGroupID,
+		Name:             name,
+		Provider:         cfg.Provider,
+		Region:           cfg.Region,
+		InstanceID:       res.InstanceID,
+		SecurityGroupID:  res.SecurityGroupID,
+		AuthKeyParameter: res.AuthKeyParameter,
+		InstanceProfile:  res.InstanceProfile,
+		LaunchedAt:       launchedAt,
+		Deadline:         deadline,
+		MaxLifetime:      cfg.MaxLifetime,
 	}
 	if err := state.Save(s); err != nil {
 		display.Warn(fmt.Sprintf("Could not save state file: %v", err))
 	}
 }
 
-// waitForDevice polls the Tailscale API until the device appears or the context is cancelled.
-func waitForDevice(ctx context.Context, tsClient *tailscale.Client, hostname string) (string, error) {
-	ticker := time.NewTicker(5 * time.Second)
+// recordDevice adds the node's tailnet device ID to its state file, so later
+// lookups go by ID rather than by name.
+func recordDevice(name, deviceID string) {
+	s, err := state.Load(name)
+	if err != nil || s == nil {
+		display.Warn(fmt.Sprintf("Could not record device ID in state file: %v", err))
+		return
+	}
+	s.DeviceID = deviceID
+	if err := state.Save(s); err != nil {
+		display.Warn(fmt.Sprintf("Could not record device ID in state file: %v", err))
+	}
+}
+
+// nodeDevice returns the tailnet device bound to a node: the one recorded when
+// it joined, or failing that the one whose hostname carries its instance ID.
+func nodeDevice(ctx context.Context, tsClient control.Plane, s *state.State) (*control.Device, error) {
+	if s.DeviceID != "" {
+		return control.GetDevice(ctx, tsClient, s.Name, s.DeviceID)
+	}
+	return control.FindDevice(ctx, tsClient, s.Name, s.InstanceID)
+}
+
+// waitForDevice polls the control server until the device of the node launched
+// as instanceID appears or the context is cancelled. It gives up at once if
+// more than one device could be the node. Meanwhile boot
+// shows the node's progress, and waitForDevice gives up if the node reports
+// its bootstrap script failed; either way, boot explains what went wrong.
+func waitForDevice(ctx context.Context, tsClient control.Plane, name, instanceID string, boot *bootReporter) (string, error) {
+	ticker := time.NewTicker(devicePollInterval)
 	defer ticker.Stop()
 
-	timeout := time.After(3 * time.Minute)
+	timeout := time.After(deviceJoinTimeout)
 
 	for {
-		deviceID, err := tsClient.FindDevice(ctx, hostname)
+		dev, err := control.FindDevice(ctx, tsClient, name, instanceID)
 		if err == nil {
-			return deviceID, nil
+			return dev.ID, nil
+		}
+		if errors.Is(err, control.ErrAmbiguous) {
+			return "", err
+		}
+		if err := boot.poll(ctx); err != nil {
+			boot.explain(ctx)
+			return "", err
 		}
 
 		select {
 		case <-ctx.Done():
 			return "", ctx.Err()
 		case <-timeout:
+			boot.explain(ctx)
 			return "", fmt.Errorf("timed out waiting for device to join tailnet")
 		case <-ticker.C:
 		}
 	}
 }
 
-func teardown(awsCfg aws.Config, res *mayaws.Resources, cfg *config.Config) {
+func teardown(provider cloud.Provider, res *cloud.Resources, cfg *config.Config, name string) {
 	// Remove device from tailnet (best-effort).
 	display.Status("Removing device from tailnet...")
-	tsClient := tailscale.NewClient(cfg.TailscaleAPIKey, cfg.TailscaleTailnet)
+	tsClient := newControl(cfg)
 
 	ctx := context.Background()
-	deviceID, err := tsClient.FindDevice(ctx, userdata.Hostname())
-	if err != nil {
+	s, _ := state.Load(name)
+	if s == nil {
+		s = &state.State{Name: name, InstanceID: res.InstanceID}
+	}
+	dev, err := nodeDevice(ctx, tsClient, s)
+	switch {
+	case errors.Is(err, control.ErrAmbiguous):
+		display.Warn(fmt.Sprintf("Not removing any device from tailnet: %v", err))
+	case err != nil:
 		display.Warn(fmt.Sprintf("Device not found in tailnet (may not have joined yet): %v", err))
-	} else {
-		if err := tsClient.RemoveDevice(ctx, deviceID); err != nil {
+	default:
+		if err := tsClient.RemoveDevice(ctx, dev.ID); err != nil {
 			display.Warn(fmt.Sprintf("Failed to remove device: %v", err))
 		} else {
 			display.Success("Device removed from tailnet")
@@ -192,15 +507,15 @@ func teardown(awsCfg aws.Config, res *mayaws.Resources, cfg *config.Config) {
 	}
 
 	// Terminate instance + delete security group.
-	display.Status("Terminating EC2 instance...")
-	if err := mayaws.Teardown(awsCfg, res); err != nil {
-		display.Error(fmt.Sprintf("AWS teardown error: %v", err))
+	display.Status("Terminating instance...")
+	if err := provider.Teardown(ctx, res); err != nil {
+		display.Error(fmt.Sprintf("Cloud teardown error: %v", err))
 	} else {
 		display.Success("Instance terminated and security group deleted")
 	}
 
 	// Clear state file after successful teardown.
-	if err := state.Clear(); err != nil {
+	if err := state.Clear(name); err != nil {
 		display.Warn(fmt.Sprintf("Could not clear state file: %v", err))
 	}
 }
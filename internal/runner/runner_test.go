@@ -0,0 +1,637 @@
+package runner
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jamesboyd/mayfly/internal/cloud"
+	"github.com/jamesboyd/mayfly/internal/cloud/fake"
+	"github.com/jamesboyd/mayfly/internal/config"
+	"github.com/jamesboyd/mayfly/internal/control"
+	"github.com/jamesboyd/mayfly/internal/state"
+	"github.com/jamesboyd/mayfly/internal/tailscale"
+	"github.com/jamesboyd/mayfly/internal/tailscale/tailscaletest"
+)
+
+// setup points state at a temporary home directory and swaps in a fake
+// cloud provider and a fake Tailscale API. Every instance the provider
+// launches joins the fake tailnet under its hostname.
+func setup(t *testing.T) (*fake.Provider, *tailscaletest.Server) {
+	t.Helper()
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+
+	srv := tailscaletest.NewServer()
+	t.Cleanup(srv.Close)
+
+	p := fake.New()
+	p.OnProvision = func(spec cloud.Spec, res *cloud.Resources) {
+		srv.Join(control.Hostname(spec.Name, res.InstanceID))
+	}
+
+	origProvider, origControl := newProvider, newControl
+	origPoll, origTimeout, origInstancePoll, origConsolePoll, origDeadlinePoll := devicePollInterval, deviceJoinTimeout, instancePollInterval, consolePollInterval, deadlinePollInterval
+	t.Cleanup(func() {
+		newProvider, newControl = origProvider, origControl
+		devicePollInterval, deviceJoinTimeout, instancePollInterval, consolePollInterval, deadlinePollInterval = origPoll, origTimeout, origInstancePoll, origConsolePoll, origDeadlinePoll
+	})
+
+	newProvider = func(ctx context.Context, cfg *config.Config, provider, region string) (cloud.Provider, error) {
+		return p, nil
+	}
+	newControl = func(cfg *config.Config) control.Plane {
+		return tailscale.NewClient(tailscaleCredentials(cfg), cfg.TailscaleTailnet, tailscale.WithBaseURL(srv.BaseURL()))
+	}
+	devicePollInterval = 10 * time.Millisecond
+	deviceJoinTimeout = time.Second
+	instancePollInterval = 10 * time.Millisecond
+	consolePollInterval = 10 * time.Millisecond
+	deadlinePollInterval = 10 * time.Millisecond
+
+	return p, srv
+}
+
+func testConfig(ttl time.Duration) *config.Config {
+	return &config.Config{
+		Region:           "us-west-2",
+		TTL:              ttl,
+		InstanceType:     "t3.micro",
+		Image:            "al2023",
+		TailscaleVersion: "1.88.3",
+		TailscaleAuthKey: "tskey-auth-test",
+		TailscaleAPIKey:  "tskey-api-test",
+		TailscaleTailnet: "example.com",
+		MaxLifetime:      12 * time.Hour,
+	}
+}
+
+// recordNode provisions an instance directly and records it in the state
+// directory, as if an earlier run had been killed.
+func recordNode(t *testing.T, p *fake.Provider, name string) *state.State {
+	t.Helper()
+
+	res, err := p.Provision(context.Background(), cloud.Spec{Name: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &state.State{
+		Name:            name,
+		Region:          "us-west-2",
+		InstanceID:      res.InstanceID,
+		SecurityGroupID: res.SecurityGroupID,
+		LaunchedAt:      time.Now(),
+		Deadline:        time.Now().Add(time.Hour),
+	}
+	if err := state.Save(s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func assertAllTornDown(t *testing.T, p *fake.Provider) {
+	t.Helper()
+
+	if ids := p.Instances(); len(ids) != 0 {
+		t.Errorf("instances left running: %v", ids)
+	}
+	if ids := p.SecurityGroups(); len(ids) != 0 {
+		t.Errorf("security groups left behind: %v", ids)
+	}
+	if names := p.Secrets(); len(names) != 0 {
+		t.Errorf("auth keys left behind: %v", names)
+	}
+	nodes, err := state.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 0 {
+		t.Errorf("state files left behind: %d", len(nodes))
+	}
+}
+
+func assertNoDevices(t *testing.T, srv *tailscaletest.Server) {
+	t.Helper()
+
+	if devices := srv.Devices(); len(devices) != 0 {
+		t.Errorf("devices left in tailnet: %v", devices)
+	}
+}
+
+func TestRunTearsDownAtTTL(t *testing.T) {
+	p, srv := setup(t)
+	srv.JoinDelay = 50 * time.Millisecond
+
+	if err := Run(context.Background(), testConfig(time.Second)); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	assertAllTornDown(t, p)
+	assertNoDevices(t, srv)
+}
+
+func TestRunTearsDownInterruptedSpotInstance(t *testing.T) {
+	p, srv := setup(t)
+	cfg := testConfig(time.Hour)
+	cfg.Spot = true
+
+	var spot bool
+	join := p.OnProvision
+	p.OnProvision = func(spec cloud.Spec, res *cloud.Resources) {
+		spot = spec.Spot
+		join(spec, res)
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			for _, id := range p.Instances() {
+				p.Interrupt(id)
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := Run(ctx, cfg); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("Run waited out the TTL instead of tearing down the interrupted instance")
+	}
+	if !spot {
+		t.Error("instance was not launched as spot")
+	}
+
+	assertAllTornDown(t, p)
+	assertNoDevices(t, srv)
+}
+
+func TestRunPicksDefaultInstanceType(t *testing.T) {
+	p, _ := setup(t)
+	cfg := testConfig(time.Second)
+	cfg.InstanceType = ""
+
+	var instanceType string
+	join := p.OnProvision
+	p.OnProvision = func(spec cloud.Spec, res *cloud.Resources) {
+		instanceType = spec.InstanceType
+		join(spec, res)
+	}
+
+	if err := Run(context.Background(), cfg); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if instanceType != fake.DefaultInstanceTypeName {
+		t.Errorf("launched %q, want the provider default %q", instanceType, fake.DefaultInstanceTypeName)
+	}
+}
+
+func TestRunMintsAuthKey(t *testing.T) {
+	p, srv := setup(t)
+	cfg := testConfig(time.Second)
+	cfg.TailscaleAuthKey = ""
+	cfg.Tags = []string{"tag:exit"}
+
+	var userData, stored string
+	join := p.OnProvision
+	p.OnProvision = func(spec cloud.Spec, res *cloud.Resources) {
+		userData = spec.UserData
+		stored, _ = p.Secret(p.AuthKeyParameter(spec.Name))
+		join(spec, res)
+	}
+
+	if err := Run(context.Background(), cfg); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	keys := srv.Keys()
+	if len(keys) != 1 {
+		t.Fatalf("created %d auth keys, want 1", len(keys))
+	}
+	if keys[0].Reusable || !keys[0].Ephemeral || len(keys[0].Tags) != 1 {
+		t.Errorf("key = %+v, want a single-use ephemeral key tagged tag:exit", keys[0])
+	}
+	script, err := base64.StdEncoding.DecodeString(userData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != keys[0].Key {
+		t.Errorf("stored auth key = %q, want the created key %s", stored, keys[0].Key)
+	}
+	if strings.Contains(string(script), keys[0].Key) {
+		t.Error("user-data contains the auth key")
+	}
+	if !strings.Contains(string(script), "--authkey=file:/run/mayfly/auth-key") {
+		t.Error("user-data does not read the auth key from the fetched file")
+	}
+	assertAllTornDown(t, p)
+}
+
+func TestRunSkipsApprovalWhenPolicyAutoApproves(t *testing.T) {
+	p, srv := setup(t)
+	srv.Policy = `{"autoApprovers": {"exitNode": ["tag:exit"]}}`
+	cfg := testConfig(time.Second)
+	cfg.Tags = []string{"tag:exit"}
+	cfg.CheckPolicy = true
+
+	var userData string
+	join := p.OnProvision
+	p.OnProvision = func(spec cloud.Spec, res *cloud.Resources) {
+		userData = spec.UserData
+		join(spec, res)
+	}
+
+	if err := Run(context.Background(), cfg); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	if routed := srv.RouteUpdates(); len(routed) != 0 {
+		t.Errorf("routes set through the API for %v, want none", routed)
+	}
+	script, _ := base64.StdEncoding.DecodeString(userData)
+	if !strings.Contains(string(script), "--advertise-tags='tag:exit'") {
+		t.Error("user-data does not advertise tag:exit")
+	}
+}
+
+func TestRunApprovesWhenPolicyDoesNotCover(t *testing.T) {
+	_, srv := setup(t)
+	srv.Policy = `{"autoApprovers": {"exitNode": ["tag:other"]}}`
+	cfg := testConfig(time.Second)
+	cfg.Tags = []string{"tag:exit"}
+	cfg.CheckPolicy = true
+
+	if err := Run(context.Background(), cfg); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	if routed := srv.RouteUpdates(); len(routed) != 1 {
+		t.Errorf("routes set through the API for %v, want the node's device", routed)
+	}
+}
+
+func TestRunDeviceNeverJoins(t *testing.T) {
+	p, srv := setup(t)
+	p.OnProvision = nil
+
+	// A node that never reaches the tailnet is still torn down at its TTL.
+	if err := Run(context.Background(), testConfig(time.Second)); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	assertAllTornDown(t, p)
+	assertNoDevices(t, srv)
+}
+
+func TestWaitForDeviceAndApprove(t *testing.T) {
+	_, srv := setup(t)
+	srv.JoinDelay = 100 * time.Millisecond
+	ctl := newControl(testConfig(time.Hour))
+
+	want := srv.Join("mayfly-us-west-2-join-i-fake1")
+	id, err := waitForDevice(context.Background(), ctl, "mayfly-us-west-2-join", "i-fake1", nil)
+	if err != nil {
+		t.Fatalf("waitForDevice: %v", err)
+	}
+	if id != want {
+		t.Fatalf("waitForDevice = %s, want %s", id, want)
+	}
+
+	if err := ctl.ApproveExitNode(context.Background(), id); err != nil {
+		t.Fatalf("ApproveExitNode: %v", err)
+	}
+	dev, _ := srv.Device(id)
+	if len(dev.EnabledRoutes) != 2 {
+		t.Errorf("enabled routes = %v, want both exit routes", dev.EnabledRoutes)
+	}
+}
+
+func TestRunLeavesLookalikeDevicesAlone(t *testing.T) {
+	p, srv := setup(t)
+
+	// A neighbour whose name merely starts with the node's must survive the
+	// node's teardown.
+	join := p.OnProvision
+	p.OnProvision = func(spec cloud.Spec, res *cloud.Resources) {
+		join(spec, res)
+		srv.Join(control.Hostname(spec.Name, res.InstanceID) + "-1")
+	}
+
+	if err := Run(context.Background(), testConfig(time.Second)); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	devices := srv.Devices()
+	if len(devices) != 1 || !strings.HasSuffix(devices[0].Hostname, "-1") {
+		t.Errorf("devices left = %+v, want only the lookalike", devices)
+	}
+}
+
+func TestRunRefusesAmbiguousDevices(t *testing.T) {
+	p, srv := setup(t)
+
+	// Two devices joining under the node's name: neither can be trusted.
+	join := p.OnProvision
+	p.OnProvision = func(spec cloud.Spec, res *cloud.Resources) {
+		join(spec, res)
+		join(spec, res)
+	}
+
+	if err := Run(context.Background(), testConfig(time.Second)); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	assertAllTornDown(t, p)
+	devices := srv.Devices()
+	if len(devices) != 2 {
+		t.Fatalf("devices left = %+v, want both ambiguous devices", devices)
+	}
+	for _, d := range devices {
+		if len(d.EnabledRoutes) != 0 {
+			t.Errorf("device %s was approved despite the ambiguous match", d.ID)
+		}
+	}
+}
+
+func TestWaitForDeviceTimesOut(t *testing.T) {
+	setup(t)
+	deviceJoinTimeout = 50 * time.Millisecond
+
+	_, err := waitForDevice(context.Background(), newControl(testConfig(time.Hour)), "mayfly-us-west-2-absent", "i-fake1", nil)
+	if err == nil {
+		t.Fatal("waitForDevice succeeded for a device that never joined")
+	}
+}
+
+func TestWaitForDeviceStopsWhenBootstrapFails(t *testing.T) {
+	p, _ := setup(t)
+	deviceJoinTimeout = time.Hour
+	p.OnProvision = nil
+	p.Console = "mayfly-stage: forwarding-enabled\nmayfly-failed: line 31\nmayfly-log: curl: (6) Could not resolve host\n"
+
+	res, err := p.Provision(context.Background(), cloud.Spec{Name: "mayfly-us-west-2-broken"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = waitForDevice(context.Background(), newControl(testConfig(time.Hour)), "mayfly-us-west-2-broken", res.InstanceID, newBootReporter(p, res.InstanceID))
+	if err == nil || !strings.Contains(err.Error(), "line 31") {
+		t.Fatalf("waitForDevice error = %v, want the failing line", err)
+	}
+}
+
+func TestRunRejectsUnrecognisedUserDataPart(t *testing.T) {
+	p, _ := setup(t)
+	notes := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(notes, []byte("not a cloud-init part\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(time.Hour)
+	cfg.UserDataAppend = []string{notes}
+
+	if err := Run(context.Background(), cfg); err == nil {
+		t.Fatal("Run succeeded with an unrecognised user-data part")
+	}
+	if got := p.Instances(); len(got) != 0 {
+		t.Errorf("instances launched: %v", got)
+	}
+}
+
+func TestRunChecksUserDataSizeBeforeMintingKey(t *testing.T) {
+	p, srv := setup(t)
+	big := filepath.Join(t.TempDir(), "big.sh")
+	if err := os.WriteFile(big, []byte("#!/bin/sh\n"+strings.Repeat("#", p.MaxUserData())), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(time.Hour)
+	cfg.TailscaleAuthKey = ""
+	cfg.UserDataAppend = []string{big}
+
+	err := Run(context.Background(), cfg)
+	if err == nil || !strings.Contains(err.Error(), "over the 16384 bytes AWS accepts") {
+		t.Fatalf("Run error = %v, want the user-data rejected as over AWS's limit", err)
+	}
+	if keys := srv.Keys(); len(keys) != 0 {
+		t.Errorf("created %d auth keys for user-data that can't be launched", len(keys))
+	}
+	if got := p.Instances(); len(got) != 0 {
+		t.Errorf("instances launched: %v", got)
+	}
+}
+
+func TestRunProvisionFailureCleansUpPartialResources(t *testing.T) {
+	p, _ := setup(t)
+	p.ProvisionErr = errors.New("insufficient capacity")
+
+	err := Run(context.Background(), testConfig(time.Hour))
+	if !errors.Is(err, p.ProvisionErr) {
+		t.Fatalf("Run error = %v, want %v", err, p.ProvisionErr)
+	}
+
+	assertAllTornDown(t, p)
+}
+
+func TestRunInterruptTearsDown(t *testing.T) {
+	p, _ := setup(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Interrupt once the node is up and recorded.
+	go func() {
+		for {
+			if nodes, _ := state.List(); len(nodes) == 1 && nodes[0].InstanceID != "" {
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	done := make(chan error, 1)
+	go func() { done <- Run(ctx, testConfig(time.Hour)) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after interrupt")
+	}
+
+	assertAllTornDown(t, p)
+}
+
+func TestRunCleansUpOrphans(t *testing.T) {
+	p, _ := setup(t)
+	orphan := recordNode(t, p, "mayfly-us-west-2-orphan")
+
+	// Stop the run right after orphan cleanup.
+	p.LookupImageErr = errors.New("stop here")
+	if err := Run(context.Background(), testConfig(time.Hour)); !errors.Is(err, p.LookupImageErr) {
+		t.Fatalf("Run error = %v, want %v", err, p.LookupImageErr)
+	}
+
+	if _, ok := p.Spec(orphan.InstanceID); ok {
+		t.Errorf("orphaned instance %s was not torn down", orphan.InstanceID)
+	}
+	assertAllTornDown(t, p)
+}
+
+func TestRunLeavesNodesWithLiveOwnerAlone(t *testing.T) {
+	p, _ := setup(t)
+	live := recordNode(t, p, "mayfly-us-west-2-live")
+
+	// Our parent (the test runner) stands in for another live mayfly process,
+	// with the node's lock held on its behalf.
+	if err := state.SavePID(live.Name); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { state.ClearPID(live.Name) })
+	writePID(t, live.Name, os.Getppid())
+
+	p.LookupImageErr = errors.New("stop here")
+	Run(context.Background(), testConfig(time.Hour))
+
+	if _, ok := p.Spec(live.InstanceID); !ok {
+		t.Errorf("node %s managed by a live process was torn down", live.Name)
+	}
+}
+
+func TestExtendKeepsLaunchMaxLifetime(t *testing.T) {
+	p, _ := setup(t)
+	s := recordNode(t, p, "mayfly-us-west-2-capped")
+	s.MaxLifetime = 2 * time.Hour
+	if err := state.Save(s); err != nil {
+		t.Fatal(err)
+	}
+
+	// The config's own max lifetime (12h) doesn't loosen the node's.
+	if err := Extend(context.Background(), testConfig(time.Hour), s.Name, 8*time.Hour); err == nil {
+		t.Error("Extend past the node's launch max lifetime succeeded, want error")
+	}
+	if err := Extend(context.Background(), testConfig(time.Hour), s.Name, 30*time.Minute); err != nil {
+		t.Errorf("Extend within the node's max lifetime: %v", err)
+	}
+}
+
+func TestDownIgnoresReusedPID(t *testing.T) {
+	p, srv := setup(t)
+	s := recordNode(t, p, "mayfly-us-west-2-reused")
+
+	// The pidfile names a live process, our parent, that never held the
+	// node's lock, as if the owner died and its PID was reused.
+	writePID(t, s.Name, os.Getppid())
+
+	if err := Down(context.Background(), testConfig(time.Hour), s.Name); err != nil {
+		t.Fatalf("Down: %v", err)
+	}
+
+	assertAllTornDown(t, p)
+	assertNoDevices(t, srv)
+}
+
+func writePID(t *testing.T, name string, pid int) {
+	t.Helper()
+
+	pidfile := filepath.Join(os.Getenv("HOME"), ".mayfly", "nodes", name+".pid")
+	if err := os.WriteFile(pidfile, []byte(strconv.Itoa(pid)), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDownTearsDownUnmanagedNode(t *testing.T) {
+	p, srv := setup(t)
+	s := recordNode(t, p, "mayfly-us-west-2-down")
+
+	if err := Down(context.Background(), testConfig(time.Hour), s.InstanceID); err != nil {
+		t.Fatalf("Down: %v", err)
+	}
+
+	assertAllTornDown(t, p)
+	assertNoDevices(t, srv)
+}
+
+func TestExtend(t *testing.T) {
+	p, _ := setup(t)
+	s := recordNode(t, p, "mayfly-us-west-2-extend")
+	cfg := testConfig(time.Hour)
+
+	if err := Extend(context.Background(), cfg, "", 30*time.Minute); err != nil {
+		t.Fatalf("Extend: %v", err)
+	}
+
+	want := s.Deadline.Add(30 * time.Minute)
+	got, err := state.Load(s.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Deadline.Equal(want) {
+		t.Errorf("state deadline = %v, want %v", got.Deadline, want)
+	}
+	if spec, _ := p.Spec(s.InstanceID); !spec.Deadline.Equal(want) {
+		t.Errorf("instance deadline = %v, want %v", spec.Deadline, want)
+	}
+
+	if err := Extend(context.Background(), cfg, "", 12*time.Hour); err == nil {
+		t.Error("Extend past max lifetime succeeded, want error")
+	}
+}
+
+func TestSuperviseLeavesPidfileUnclaimedWithoutProvider(t *testing.T) {
+	p, _ := setup(t)
+	s := recordNode(t, p, "mayfly-us-west-2-nocreds")
+	newProvider = func(ctx context.Context, cfg *config.Config, provider, region string) (cloud.Provider, error) {
+		return nil, errors.New("no credentials")
+	}
+
+	if err := Supervise(context.Background(), testConfig(time.Hour), s.Name); err == nil {
+		t.Fatal("Supervise succeeded without a provider")
+	}
+	// `up --detach` waits for the pidfile, so it must see the handoff fail.
+	if pid, err := state.LoadPID(s.Name); err != nil || pid != 0 {
+		t.Errorf("pidfile = %d, %v; want none", pid, err)
+	}
+}
+
+func TestWatchDeadline(t *testing.T) {
+	p, _ := setup(t)
+	s := recordNode(t, p, "mayfly-us-west-2-watch")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	extend := watchDeadline(ctx, s.Name, s.Deadline)
+
+	// An earlier deadline is not an extension.
+	earlier := *s
+	earlier.Deadline = s.Deadline.Add(-time.Minute)
+	if err := state.Save(&earlier); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case d := <-extend:
+		t.Fatalf("watchDeadline sent %s, earlier than the current deadline", d)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	later := *s
+	later.Deadline = s.Deadline.Add(30 * time.Minute)
+	if err := state.Save(&later); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case d := <-extend:
+		if !d.Equal(later.Deadline) {
+			t.Errorf("watchDeadline sent %s, want %s", d, later.Deadline)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watchDeadline never picked up the extension")
+	}
+}
@@ -1,29 +1,66 @@
 package state
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// legacyName is the node name given to a state file left by a version of
+// Mayfly that supported only one node, whose hostname was always mayfly-exit.
+const legacyName = "mayfly-exit"
+
 type State struct {
-	Region          string `json:"region"`
-	InstanceID      string `json:"instance_id,omitempty"`
-	SecurityGroupID string `json:"security_group_id,omitempty"`
+	Name             string        `json:"name"`
+	Provider         string        `json:"provider,omitempty"` // empty for nodes recorded before providers other than AWS
+	Region           string        `json:"region"`
+	InstanceID       string        `json:"instance_id,omitempty"`
+	SecurityGroupID  string        `json:"security_group_id,omitempty"`
+	AuthKeyParameter string        `json:"auth_key_parameter,omitempty"` // empty for providers that embed the key in user-data
+	InstanceProfile  string        `json:"instance_profile,omitempty"`
+	MaxLifetime      time.Duration `json:"max_lifetime,omitempty"` // zero for nodes recorded before it was kept
+	DeviceID         string        `json:"device_id,omitempty"`
+	LaunchedAt       time.Time     `json:"launched_at"`
+	Deadline         time.Time     `json:"deadline"`
+}
+
+// NewName returns a fresh node name of the form mayfly-<region>-<shortid>.
+// It doubles as the instance's tailnet hostname, so it must be unique.
+func NewName(region string) string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return fmt.Sprintf("mayfly-%s-%s", region, hex.EncodeToString(b))
 }
 
-func path() (string, error) {
+func baseDir() (string, error) {
 	home, err := os.UserHomeDir()
 	if err != nil {
 		return "", err
 	}
-	return filepath.Join(home, ".mayfly", "state.json"), nil
+	return filepath.Join(home, ".mayfly"), nil
 }
 
-// Save writes the state to disk.
-func Save(s *State) error {
-	p, err := path()
+// path returns the path of a node's file with the given extension.
+func path(name, ext string) (string, error) {
+	base, err := baseDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, "nodes", name+ext), nil
+}
+
+// writeFile writes data to a node's file, creating the directory if needed.
+func writeFile(name, ext string, data []byte) error {
+	p, err := path(name, ext)
 	if err != nil {
 		return err
 	}
@@ -32,17 +69,40 @@ func Save(s *State) error {
 		return err
 	}
 
+	return os.WriteFile(p, data, 0600)
+}
+
+// removeFile deletes a node's file. A missing file is not an error.
+func removeFile(name, ext string) error {
+	p, err := path(name, ext)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Save writes the node's state to disk.
+func Save(s *State) error {
 	data, err := json.MarshalIndent(s, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(p, data, 0600)
+	return writeFile(s.Name, ".json", data)
 }
 
-// Load reads the state from disk. Returns nil if no state file exists.
-func Load() (*State, error) {
-	p, err := path()
+// Load reads a node's state from disk. Returns nil if no such node exists.
+func Load(name string) (*State, error) {
+	if err := migrateLegacy(); err != nil {
+		return nil, err
+	}
+
+	p, err := path(name, ".json")
 	if err != nil {
 		return nil, err
 	}
@@ -63,16 +123,194 @@ func Load() (*State, error) {
 	return &s, nil
 }
 
-// Clear removes the state file.
-func Clear() error {
-	p, err := path()
+// List returns the state of every recorded node, sorted by name.
+func List() ([]*State, error) {
+	if err := migrateLegacy(); err != nil {
+		return nil, err
+	}
+
+	base, err := baseDir()
+	if err != nil {
+		return nil, err
+	}
+
+	matches, err := filepath.Glob(filepath.Join(base, "nodes", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+
+	var nodes []*State
+	for _, m := range matches {
+		s, err := Load(strings.TrimSuffix(filepath.Base(m), ".json"))
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", m, err)
+		}
+		if s != nil {
+			nodes = append(nodes, s)
+		}
+	}
+	return nodes, nil
+}
+
+// Clear removes a node's state file.
+func Clear(name string) error {
+	return removeFile(name, ".json")
+}
+
+// migrateLegacy moves a single-node ~/.mayfly/state.json into the nodes directory.
+func migrateLegacy() error {
+	base, err := baseDir()
 	if err != nil {
 		return err
 	}
 
-	err = os.Remove(p)
-	if errors.Is(err, os.ErrNotExist) {
+	legacy := filepath.Join(base, "state.json")
+	data, err := os.ReadFile(legacy)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	var s State
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("reading legacy state file: %w", err)
+	}
+	s.Name = legacyName
+
+	if err := Save(&s); err != nil {
+		return err
+	}
+	return os.Remove(legacy)
+}
+
+// held holds the node lock files this process has taken, by node name.
+var (
+	heldMu sync.Mutex
+	held   = map[string]*os.File{}
+)
+
+// SavePID records the current process as the one managing the node, so other
+// commands can signal it instead of acting on the node themselves. It also
+// locks the node's lock file for as long as the process manages the node, so
+// a pidfile left behind is never mistaken for a live owner once its PID is
+// reused. If another process still holds the lock, as the foreground `up`
+// does while handing a node to its supervisor, SavePID waits for it.
+func SavePID(name string) error {
+	if err := writeFile(name, ".pid", []byte(strconv.Itoa(os.Getpid())+"\n")); err != nil {
+		return err
+	}
+
+	heldMu.Lock()
+	_, ok := held[name]
+	heldMu.Unlock()
+	if ok {
 		return nil
 	}
-	return err
+
+	p, err := path(name, ".lock")
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return fmt.Errorf("locking %s: %w", p, err)
+	}
+
+	heldMu.Lock()
+	held[name] = f
+	heldMu.Unlock()
+	return nil
+}
+
+// LoadPID returns the PID from the node's pidfile. Returns 0 if no pidfile exists.
+func LoadPID(name string) (int, error) {
+	p, err := path(name, ".pid")
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := os.ReadFile(p)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// Owner returns the PID of the process managing the node, or 0 if the
+// pidfile is missing or stale: its process no longer holds the node's lock.
+func Owner(name string) (int, error) {
+	pid, err := LoadPID(name)
+	if err != nil || pid == 0 {
+		return 0, err
+	}
+
+	p, err := path(name, ".lock")
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(p, os.O_RDWR, 0600)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	free, err := tryLockFile(f)
+	if err != nil {
+		return 0, fmt.Errorf("checking %s: %w", p, err)
+	}
+	if free {
+		return 0, nil
+	}
+	return pid, nil
+}
+
+// ClearPID removes the node's pidfile if it still names the current process,
+// so a process that has handed the node to another never removes its
+// successor's PID. It releases the node's lock either way.
+func ClearPID(name string) error {
+	defer release(name)
+
+	pid, err := LoadPID(name)
+	if err != nil || pid != os.Getpid() {
+		return err
+	}
+	return removeFile(name, ".pid")
+}
+
+// release closes the node's lock file if this process holds it. The lock
+// file itself is removed once the node's state file is gone.
+func release(name string) {
+	heldMu.Lock()
+	f, ok := held[name]
+	delete(held, name)
+	heldMu.Unlock()
+	if !ok {
+		return
+	}
+
+	f.Close()
+	if p, err := path(name, ".json"); err == nil {
+		if _, err := os.Stat(p); errors.Is(err, os.ErrNotExist) {
+			removeFile(name, ".lock")
+		}
+	}
+}
+
+// LogPath returns the path of the node's detached supervisor log file.
+func LogPath(name string) (string, error) {
+	return path(name, ".log")
 }
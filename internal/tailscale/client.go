@@ -3,9 +3,14 @@ package tailscale
 import (
 	"context"
 	"fmt"
+	"net/url"
 	"strings"
+	"time"
 
 	tsclient "github.com/tailscale/tailscale-client-go/v2"
+	"golang.org/x/oauth2/clientcredentials"
+
+	"github.com/jamesboyd/mayfly/internal/control"
 )
 
 // Client wraps the Tailscale API client.
@@ -13,31 +18,72 @@ type Client struct {
 	inner *tsclient.Client
 }
 
-// NewClient creates a Tailscale API client.
-func NewClient(apiKey, tailnet string) *Client {
-	return &Client{
-		inner: &tsclient.Client{
-			APIKey:  apiKey,
-			Tailnet: tailnet,
-		},
+var (
+	_ control.Plane          = (*Client)(nil)
+	_ control.AuthKeyCreator = (*Client)(nil)
+	_ control.PolicyReader   = (*Client)(nil)
+)
+
+// Option configures a Client.
+type Option func(*tsclient.Client)
+
+// WithBaseURL points the client at a different API server, such as a test fake.
+func WithBaseURL(u *url.URL) Option {
+	return func(c *tsclient.Client) {
+		c.BaseURL = u
+	}
+}
+
+// Credentials authenticate to the Tailscale API with either a personal API
+// key or an OAuth client.
+type Credentials struct {
+	APIKey            string
+	OAuthClientID     string
+	OAuthClientSecret string
+}
+
+var defaultBaseURL = &url.URL{Scheme: "https", Host: "api.tailscale.com"}
+
+// NewClient creates a Tailscale API client. With OAuth client credentials,
+// access tokens are obtained and refreshed as needed.
+func NewClient(creds Credentials, tailnet string, opts ...Option) *Client {
+	inner := &tsclient.Client{
+		BaseURL: defaultBaseURL,
+		APIKey:  creds.APIKey,
+		Tailnet: tailnet,
+	}
+	for _, opt := range opts {
+		opt(inner)
+	}
+
+	if creds.OAuthClientID != "" {
+		oauth := clientcredentials.Config{
+			ClientID:     creds.OAuthClientID,
+			ClientSecret: creds.OAuthClientSecret,
+			TokenURL:     inner.BaseURL.JoinPath("/api/v2/oauth/token").String(),
+		}
+		// The token source outlives any one request, so it gets its own context.
+		inner.HTTP = oauth.Client(context.Background())
+		inner.HTTP.Timeout = time.Minute
+		inner.APIKey = ""
 	}
+	return &Client{inner: inner}
 }
 
-// FindDevice searches for a device whose hostname starts with the given prefix.
-// Returns the device ID if found.
-func (c *Client) FindDevice(ctx context.Context, hostnamePrefix string) (string, error) {
+// ListDevices returns every device whose hostname starts with the given prefix.
+func (c *Client) ListDevices(ctx context.Context, hostnamePrefix string) ([]control.Device, error) {
 	devices, err := c.inner.Devices().List(ctx)
 	if err != nil {
-		return "", fmt.Errorf("listing devices: %w", err)
+		return nil, fmt.Errorf("listing devices: %w", err)
 	}
 
+	var matches []control.Device
 	for _, d := range devices {
 		if strings.HasPrefix(d.Hostname, hostnamePrefix) {
-			return d.ID, nil
+			matches = append(matches, control.Device{ID: d.ID, Hostname: d.Hostname, Created: d.Created.Time, LastSeen: d.LastSeen.Time})
 		}
 	}
-
-	return "", fmt.Errorf("device with hostname prefix %q not found", hostnamePrefix)
+	return matches, nil
 }
 
 // ApproveExitNode enables exit node routes (0.0.0.0/0 and ::/0) for a device.
@@ -56,3 +102,32 @@ func (c *Client) RemoveDevice(ctx context.Context, deviceID string) error {
 	}
 	return nil
 }
+
+// CreateAuthKey creates a single-use, ephemeral, preauthorized auth key, so a
+// key read from the instance's user-data is useless once the node has joined.
+func (c *Client) CreateAuthKey(ctx context.Context, req control.KeyRequest) (string, error) {
+	var caps tsclient.KeyCapabilities
+	caps.Devices.Create.Reusable = false
+	caps.Devices.Create.Ephemeral = true
+	caps.Devices.Create.Preauthorized = true
+	caps.Devices.Create.Tags = req.Tags
+
+	key, err := c.inner.Keys().Create(ctx, tsclient.CreateKeyRequest{
+		Capabilities:  caps,
+		ExpirySeconds: int64(req.Expiry.Seconds()),
+		Description:   "mayfly exit node",
+	})
+	if err != nil {
+		return "", fmt.Errorf("creating auth key: %w", err)
+	}
+	return key.Key, nil
+}
+
+// Policy returns the tailnet policy file as HuJSON.
+func (c *Client) Policy(ctx context.Context) ([]byte, error) {
+	acl, err := c.inner.PolicyFile().Raw(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reading policy file: %w", err)
+	}
+	return []byte(acl.HuJSON), nil
+}
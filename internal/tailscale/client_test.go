@@ -0,0 +1,133 @@
+package tailscale
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jamesboyd/mayfly/internal/control"
+	"github.com/jamesboyd/mayfly/internal/tailscale/tailscaletest"
+)
+
+func newTestClient(t *testing.T) (*Client, *tailscaletest.Server) {
+	t.Helper()
+
+	srv := tailscaletest.NewServer()
+	t.Cleanup(srv.Close)
+	return NewClient(Credentials{APIKey: "tskey-api-test"}, "example.com", WithBaseURL(srv.BaseURL())), srv
+}
+
+func TestListDevicesFiltersByPrefix(t *testing.T) {
+	c, srv := newTestClient(t)
+	want := srv.Join("mayfly-us-west-2-abc123")
+	srv.Join("laptop")
+
+	devices, err := c.ListDevices(context.Background(), "mayfly-")
+	if err != nil {
+		t.Fatalf("ListDevices: %v", err)
+	}
+	if len(devices) != 1 || devices[0].ID != want {
+		t.Fatalf("ListDevices = %+v, want only %s", devices, want)
+	}
+	if !devices[0].Online() {
+		t.Error("freshly joined device reported offline")
+	}
+}
+
+func TestApproveExitNode(t *testing.T) {
+	c, srv := newTestClient(t)
+	id := srv.Join("mayfly-us-west-2-abc123")
+
+	if err := c.ApproveExitNode(context.Background(), id); err != nil {
+		t.Fatalf("ApproveExitNode: %v", err)
+	}
+
+	dev, _ := srv.Device(id)
+	if len(dev.EnabledRoutes) != 2 || dev.EnabledRoutes[0] != "0.0.0.0/0" || dev.EnabledRoutes[1] != "::/0" {
+		t.Errorf("enabled routes = %v, want [0.0.0.0/0 ::/0]", dev.EnabledRoutes)
+	}
+}
+
+func TestRemoveDevice(t *testing.T) {
+	c, srv := newTestClient(t)
+	id := srv.Join("mayfly-us-west-2-abc123")
+
+	if err := c.RemoveDevice(context.Background(), id); err != nil {
+		t.Fatalf("RemoveDevice: %v", err)
+	}
+	if _, ok := srv.Device(id); ok {
+		t.Error("device still registered after RemoveDevice")
+	}
+
+	if err := c.RemoveDevice(context.Background(), id); err == nil {
+		t.Error("removing an unknown device succeeded, want error")
+	}
+}
+
+func TestCreateAuthKey(t *testing.T) {
+	c, srv := newTestClient(t)
+
+	key, err := c.CreateAuthKey(context.Background(), control.KeyRequest{
+		Expiry: 10 * time.Minute,
+		Tags:   []string{"tag:exit"},
+	})
+	if err != nil {
+		t.Fatalf("CreateAuthKey: %v", err)
+	}
+
+	keys := srv.Keys()
+	if len(keys) != 1 || keys[0].Key != key {
+		t.Fatalf("server keys = %+v, want only %s", keys, key)
+	}
+	k := keys[0]
+	if k.Reusable || !k.Ephemeral || !k.Preauthorized {
+		t.Errorf("key = %+v, want single-use, ephemeral and preauthorized", k)
+	}
+	if len(k.Tags) != 1 || k.Tags[0] != "tag:exit" {
+		t.Errorf("key tags = %v, want [tag:exit]", k.Tags)
+	}
+	if time.Until(k.Expires) > 10*time.Minute {
+		t.Errorf("key expires %v, want within 10m", k.Expires)
+	}
+}
+
+func TestOAuthClientRefreshesTokens(t *testing.T) {
+	srv := tailscaletest.NewServer()
+	t.Cleanup(srv.Close)
+	srv.OAuthClientID = "client-id"
+	srv.OAuthClientSecret = "tskey-client-secret"
+	// Tokens this short-lived count as expired straight away, so every
+	// request needs a fresh one.
+	srv.TokenLifetime = time.Second
+
+	c := NewClient(Credentials{OAuthClientID: "client-id", OAuthClientSecret: "tskey-client-secret"}, "-", WithBaseURL(srv.BaseURL()))
+	for range 2 {
+		if _, err := c.ListDevices(context.Background(), "mayfly-"); err != nil {
+			t.Fatalf("ListDevices: %v", err)
+		}
+	}
+	if n := srv.TokensIssued(); n != 2 {
+		t.Errorf("tokens issued = %d, want 2", n)
+	}
+
+	bad := NewClient(Credentials{OAuthClientID: "client-id", OAuthClientSecret: "wrong"}, "-", WithBaseURL(srv.BaseURL()))
+	if _, err := bad.ListDevices(context.Background(), "mayfly-"); err == nil {
+		t.Error("ListDevices with a bad client secret succeeded, want error")
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	c, srv := newTestClient(t)
+	srv.Policy = `{
+		// Comments and trailing commas survive the round trip.
+		"autoApprovers": {"exitNode": ["tag:exit"]},
+	}`
+
+	policy, err := c.Policy(context.Background())
+	if err != nil {
+		t.Fatalf("Policy: %v", err)
+	}
+	if string(policy) != srv.Policy {
+		t.Errorf("Policy = %q, want %q", policy, srv.Policy)
+	}
+}
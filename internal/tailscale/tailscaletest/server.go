@@ -0,0 +1,384 @@
+// Package tailscaletest provides a fake Tailscale API server, so code that
+// manages tailnet devices can be tested offline.
+package tailscaletest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Device is a device registered with the fake server.
+type Device struct {
+	ID               string
+	Hostname         string
+	JoinedAt         time.Time // the device is listed from this time on
+	AdvertisedRoutes []string
+	EnabledRoutes    []string
+}
+
+// Key is an auth key created through the fake server.
+type Key struct {
+	ID            string
+	Key           string
+	Reusable      bool
+	Ephemeral     bool
+	Preauthorized bool
+	Tags          []string
+	Expires       time.Time
+}
+
+// Server is a fake Tailscale API covering device list, get, delete and
+// routes, auth key creation and reading the policy file. Requests must
+// authenticate with an API key (any non-empty one) or an access token issued
+// by its OAuth token endpoint.
+// Close it when done.
+type Server struct {
+	*httptest.Server
+
+	// JoinDelay is how long a device registered with Join takes to appear in
+	// the device list, standing in for instance boot and tailscale up.
+	JoinDelay time.Duration
+
+	// The OAuth client the token endpoint accepts, and how long the access
+	// tokens it issues last (default one hour).
+	OAuthClientID     string
+	OAuthClientSecret string
+	TokenLifetime     time.Duration
+
+	// Policy is the HuJSON policy file served to clients (default "{}").
+	Policy string
+
+	mu      sync.Mutex
+	nextID  int
+	devices map[string]*Device
+	keys    []Key
+	tokens  map[string]time.Time // access token -> expiry
+	issued  int
+	routed  []string // device IDs whose routes were set, in order
+}
+
+// NewServer starts a fake Tailscale API server.
+func NewServer() *Server {
+	s := &Server{devices: map[string]*Device{}, tokens: map[string]time.Time{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v2/oauth/token", s.issueToken)
+	mux.HandleFunc("GET /api/v2/tailnet/{tailnet}/devices", s.listDevices)
+	mux.HandleFunc("GET /api/v2/device/{id}", s.getDevice)
+	mux.HandleFunc("DELETE /api/v2/device/{id}", s.deleteDevice)
+	mux.HandleFunc("GET /api/v2/device/{id}/routes", s.getRoutes)
+	mux.HandleFunc("POST /api/v2/device/{id}/routes", s.setRoutes)
+	mux.HandleFunc("POST /api/v2/tailnet/{tailnet}/keys", s.createKey)
+	mux.HandleFunc("GET /api/v2/tailnet/{tailnet}/acl", s.getPolicy)
+
+	s.Server = httptest.NewServer(s.authenticate(mux))
+	return s
+}
+
+// TokensIssued returns how many OAuth access tokens the server has issued.
+func (s *Server) TokensIssued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.issued
+}
+
+// authenticate rejects API requests without an API key or a live access token.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v2/oauth/token" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if key, _, ok := r.BasicAuth(); ok && key != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			s.mu.Lock()
+			expiry, known := s.tokens[token]
+			s.mu.Unlock()
+			if known && time.Now().Before(expiry) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		writeError(w, http.StatusUnauthorized, "API token invalid")
+	})
+}
+
+func (s *Server) issueToken(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.FormValue("client_id"), r.FormValue("client_secret")
+	}
+	if s.OAuthClientID == "" || id != s.OAuthClientID || secret != s.OAuthClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	lifetime := s.TokenLifetime
+	if lifetime == 0 {
+		lifetime = time.Hour
+	}
+
+	s.mu.Lock()
+	s.issued++
+	token := fmt.Sprintf("tskey-token-fake%d", s.issued)
+	s.tokens[token] = time.Now().Add(lifetime)
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(lifetime.Seconds()),
+	})
+}
+
+// BaseURL returns the server's URL for tailscale.WithBaseURL.
+func (s *Server) BaseURL() *url.URL {
+	u, _ := url.Parse(s.URL)
+	return u
+}
+
+// Join registers a device advertising exit node routes, as `tailscale up
+// --advertise-exit-node` would. It is listed once JoinDelay has passed.
+// Returns the device ID.
+func (s *Server) Join(hostname string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	id := fmt.Sprintf("dev%d", s.nextID)
+	s.devices[id] = &Device{
+		ID:               id,
+		Hostname:         hostname,
+		JoinedAt:         time.Now().Add(s.JoinDelay),
+		AdvertisedRoutes: []string{"0.0.0.0/0", "::/0"},
+	}
+	return id
+}
+
+// Devices returns every registered device that hasn't been deleted, including
+// those still within their join delay.
+func (s *Server) Devices() []Device {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	devices := make([]Device, 0, len(s.devices))
+	for _, d := range s.devices {
+		devices = append(devices, *d)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return devices
+}
+
+// Device returns a registered device by ID.
+func (s *Server) Device(id string) (Device, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.devices[id]
+	if !ok {
+		return Device{}, false
+	}
+	return *d, true
+}
+
+// RouteUpdates returns the IDs of devices whose routes were set through the
+// API, in order, including devices deleted since.
+func (s *Server) RouteUpdates() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.routed...)
+}
+
+// Keys returns the auth keys created so far, oldest first.
+func (s *Server) Keys() []Key {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Key(nil), s.keys...)
+}
+
+// visible returns the device if it exists and has finished joining. The
+// caller must hold s.mu.
+func (s *Server) visible(id string) (*Device, bool) {
+	d, ok := s.devices[id]
+	if !ok || time.Now().Before(d.JoinedAt) {
+		return nil, false
+	}
+	return d, true
+}
+
+type apiDevice struct {
+	ID       string    `json:"id"`
+	NodeID   string    `json:"nodeId"`
+	Hostname string    `json:"hostname"`
+	Name     string    `json:"name"`
+	Created  time.Time `json:"created"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+func toAPI(d *Device) apiDevice {
+	return apiDevice{
+		ID:       d.ID,
+		NodeID:   d.ID,
+		Hostname: d.Hostname,
+		Name:     d.Hostname + ".example.ts.net",
+		Created:  d.JoinedAt,
+		LastSeen: time.Now(),
+	}
+}
+
+func (s *Server) listDevices(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	devices := []apiDevice{}
+	for id := range s.devices {
+		if d, ok := s.visible(id); ok {
+			devices = append(devices, toAPI(d))
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+
+	writeJSON(w, http.StatusOK, map[string]any{"devices": devices})
+}
+
+func (s *Server) getDevice(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.visible(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "device not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPI(d))
+}
+
+func (s *Server) deleteDevice(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := r.PathValue("id")
+	if _, ok := s.visible(id); !ok {
+		writeError(w, http.StatusNotFound, "device not found")
+		return
+	}
+	delete(s.devices, id)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) getRoutes(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.visible(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "device not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{
+		"advertisedRoutes": d.AdvertisedRoutes,
+		"enabledRoutes":    d.EnabledRoutes,
+	})
+}
+
+func (s *Server) setRoutes(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Routes []string `json:"routes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.visible(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "device not found")
+		return
+	}
+	d.EnabledRoutes = body.Routes
+	s.routed = append(s.routed, d.ID)
+	writeJSON(w, http.StatusOK, map[string][]string{
+		"advertisedRoutes": d.AdvertisedRoutes,
+		"enabledRoutes":    d.EnabledRoutes,
+	})
+}
+
+func (s *Server) createKey(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Capabilities struct {
+			Devices struct {
+				Create struct {
+					Reusable      bool     `json:"reusable"`
+					Ephemeral     bool     `json:"ephemeral"`
+					Preauthorized bool     `json:"preauthorized"`
+					Tags          []string `json:"tags"`
+				} `json:"create"`
+			} `json:"devices"`
+		} `json:"capabilities"`
+		ExpirySeconds int64 `json:"expirySeconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	create := body.Capabilities.Devices.Create
+	key := Key{
+		ID:            fmt.Sprintf("key%d", s.nextID),
+		Key:           fmt.Sprintf("tskey-auth-fake%d", s.nextID),
+		Reusable:      create.Reusable,
+		Ephemeral:     create.Ephemeral,
+		Preauthorized: create.Preauthorized,
+		Tags:          create.Tags,
+		Expires:       time.Now().Add(time.Duration(body.ExpirySeconds) * time.Second),
+	}
+	s.keys = append(s.keys, key)
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"id":           key.ID,
+		"key":          key.Key,
+		"expires":      key.Expires,
+		"capabilities": body.Capabilities,
+	})
+}
+
+func (s *Server) getPolicy(w http.ResponseWriter, r *http.Request) {
+	policy := s.Policy
+	if policy == "" {
+		policy = "{}"
+	}
+	w.Header().Set("Content-Type", "application/hujson")
+	w.Header().Set("Etag", `"fake"`)
+	io.WriteString(w, policy)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"message": msg})
+}
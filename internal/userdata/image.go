@@ -0,0 +1,72 @@
+package userdata
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// DefaultTailscaleVersion is the Tailscale release installed when none is
+// pinned explicitly.
+const DefaultTailscaleVersion = "1.88.3"
+
+// tailscaleKeyFingerprint is the fingerprint of the key that signs
+// Tailscale's packages. The install step only trusts the key it downloads
+// from pkgs.tailscale.com if it matches.
+const tailscaleKeyFingerprint = "2596A99EAAB33821893C0A79458CA832957F5868"
+
+var tailscaleVersionPattern = regexp.MustCompile(`^[0-9]+\.[0-9]+\.[0-9]+$`)
+
+// ValidateTailscaleVersion checks that v names an exact Tailscale release.
+func ValidateTailscaleVersion(v string) error {
+	if !tailscaleVersionPattern.MatchString(v) {
+		return fmt.Errorf("tailscale version %q must look like %s", v, DefaultTailscaleVersion)
+	}
+	return nil
+}
+
+// ImageParams describe the builder instance behind `mayfly image build`.
+type ImageParams struct {
+	// OS selects the builder template: one of OSes.
+	OS string
+	// TailscaleVersion is the exact release to install, e.g. "1.88.3".
+	TailscaleVersion string
+}
+
+// GenerateImage returns the base64-encoded builder script rendered by
+// RenderImage.
+func GenerateImage(p ImageParams) (string, error) {
+	script, err := RenderImage(p)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString([]byte(script)), nil
+}
+
+// RenderImage returns a user-data script for p.OS that enables forwarding,
+// installs and verifies the pinned Tailscale release from its package
+// repository, hardens the machine and cleans it up for imaging, then powers
+// off so the instance can be snapshotted.
+func RenderImage(p ImageParams) (string, error) {
+	if !Supported(p.OS) {
+		return "", fmt.Errorf("no builder template for %q (want one of %s)", p.OS, strings.Join(OSes(), ", "))
+	}
+	if err := ValidateTailscaleVersion(p.TailscaleVersion); err != nil {
+		return "", err
+	}
+
+	tmpl, err := template.New("").Funcs(funcs).ParseFS(templateFS, "templates/signingkey.tmpl",
+		"templates/"+p.OS+".install.tmpl", "templates/"+p.OS+".image.sh.tmpl")
+	if err != nil {
+		return "", fmt.Errorf("parsing %s builder template: %w", p.OS, err)
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&b, p.OS+".image.sh.tmpl", p); err != nil {
+		return "", fmt.Errorf("rendering %s builder template: %w", p.OS, err)
+	}
+	return b.String(), nil
+}
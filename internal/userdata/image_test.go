@@ -0,0 +1,76 @@
+package userdata
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderImageGolden(t *testing.T) {
+	for _, name := range OSes() {
+		t.Run(name, func(t *testing.T) {
+			got, err := RenderImage(ImageParams{OS: name, TailscaleVersion: "1.88.3"})
+			if err != nil {
+				t.Fatalf("RenderImage: %v", err)
+			}
+
+			golden := filepath.Join("testdata", name+".image.golden")
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("reading golden file (run with -update to create it): %v", err)
+			}
+			if got != string(want) {
+				t.Errorf("RenderImage(%s) differs from %s; rerun with -update if the change is intended\n--- got ---\n%s", name, golden, got)
+			}
+		})
+	}
+}
+
+func TestRenderImageRejectsBadVersion(t *testing.T) {
+	for _, v := range []string{"", "latest", "1.88", "1.88.3; reboot"} {
+		if _, err := RenderImage(ImageParams{OS: AL2023, TailscaleVersion: v}); err == nil {
+			t.Errorf("RenderImage accepted tailscale version %q", v)
+		}
+	}
+}
+
+func TestRenderImageReportsFailure(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	for _, name := range OSes() {
+		t.Run(name, func(t *testing.T) {
+			script, err := RenderImage(ImageParams{OS: name, TailscaleVersion: "1.88.3"})
+			if err != nil {
+				t.Fatalf("RenderImage: %v", err)
+			}
+			var trap string
+			for line := range strings.Lines(script) {
+				if strings.HasPrefix(line, "trap ") && strings.HasSuffix(line, " ERR\n") {
+					trap = line
+				}
+			}
+			if trap == "" {
+				t.Fatalf("builder script sets no ERR trap:\n%s", script)
+			}
+
+			// Run the trap against a failing step, with the console on stdout
+			// and shutdown stubbed out.
+			trap = strings.ReplaceAll(trap, ">/dev/console", "")
+			out, _ := exec.Command("bash", "-c", "shutdown() { echo shutdown \"$@\"; }\nset -e\n"+trap+"false\n").Output()
+			if got := ParseProgress(string(out)).Failure; got != "line 4" {
+				t.Errorf("reported failure = %q, want %q\noutput: %s", got, "line 4", out)
+			}
+			if !strings.Contains(string(out), "shutdown -h now") {
+				t.Errorf("builder did not power off after failing\noutput: %s", out)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package userdata
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// boundary separates the parts of the user-data document.
+const boundary = "==MAYFLY-USER-DATA=="
+
+// appendMergeType makes cloud-init merge an appended cloud-config part into
+// mayfly's: lists such as runcmd and write_files are extended, and keys
+// mayfly sets are kept.
+const appendMergeType = "list(append)+dict(no_replace,recurse_list)+str()"
+
+// Part is a user-supplied cloud-init part appended to a node's user-data.
+type Part struct {
+	// Name identifies the part in errors and becomes its filename.
+	Name    string
+	Content string
+}
+
+// ReadPart reads a user-data part from a file, checking that cloud-init
+// will recognise it.
+func ReadPart(path string) (Part, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Part{}, fmt.Errorf("reading user-data part: %w", err)
+	}
+	part := Part{Name: filepath.Base(path), Content: string(data)}
+	if _, err := part.contentType(); err != nil {
+		return Part{}, err
+	}
+	return part, nil
+}
+
+// partTypes maps the first line of a part to the MIME type cloud-init
+// handles it by.
+var partTypes = []struct {
+	prefix   string
+	mimeType string
+}{
+	{"#cloud-config", "text/cloud-config"},
+	{"#cloud-boothook", "text/cloud-boothook"},
+	{"#include", "text/x-include-url"},
+	{"#!", "text/x-shellscript"},
+}
+
+func (p Part) contentType() (string, error) {
+	for _, t := range partTypes {
+		if strings.HasPrefix(p.Content, t.prefix) {
+			return t.mimeType, nil
+		}
+	}
+	return "", fmt.Errorf("user-data part %s must start with #cloud-config, #cloud-boothook, #include or #!", p.Name)
+}
+
+// mimePart is one part of the multipart user-data document.
+type mimePart struct {
+	filename  string
+	mimeType  string
+	mergeType string
+	content   string
+}
+
+// mimeDocument joins parts into the MIME multipart document cloud-init expects
+// for user-data made of several parts.
+func mimeDocument(parts []mimePart) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=%q\n", boundary)
+	b.WriteString("MIME-Version: 1.0\n")
+
+	for _, p := range parts {
+		if strings.Contains(p.content, "--"+boundary) {
+			return "", fmt.Errorf("user-data part %s contains the MIME boundary %q", p.filename, boundary)
+		}
+		fmt.Fprintf(&b, "\n--%s\n", boundary)
+		fmt.Fprintf(&b, "Content-Type: %s; charset=\"utf-8\"\n", p.mimeType)
+		fmt.Fprintf(&b, "Content-Disposition: attachment; filename=%q\n", p.filename)
+		if p.mergeType != "" {
+			fmt.Fprintf(&b, "Merge-Type: %s\n", p.mergeType)
+		}
+		b.WriteString("\n")
+		b.WriteString(strings.TrimSuffix(p.content, "\n"))
+	}
+	fmt.Fprintf(&b, "\n--%s--\n", boundary)
+	return b.String(), nil
+}
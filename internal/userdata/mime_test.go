@@ -0,0 +1,110 @@
+package userdata
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type parsedPart struct {
+	mimeType, filename, mergeType, content string
+}
+
+// parseParts reads a user-data document the way cloud-init does.
+func parseParts(t *testing.T, doc string) []parsedPart {
+	t.Helper()
+	msg, err := mail.ReadMessage(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("reading MIME document: %v", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("document Content-Type = %q (%v), want multipart/mixed", msg.Header.Get("Content-Type"), err)
+	}
+
+	var parts []parsedPart
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := r.NextPart()
+		if err == io.EOF {
+			return parts
+		}
+		if err != nil {
+			t.Fatalf("reading part: %v", err)
+		}
+		body, _ := io.ReadAll(p)
+		mimeType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		parts = append(parts, parsedPart{mimeType, p.FileName(), p.Header.Get("Merge-Type"), string(body)})
+	}
+}
+
+func TestRenderAppendsParts(t *testing.T) {
+	p := goldenParams(Ubuntu2404)
+	p.Append = []Part{
+		{Name: "org.yaml", Content: "#cloud-config\nntp:\n  servers: [ntp.example.com]\n"},
+		{Name: "agent.sh", Content: "#!/bin/sh\necho hello\n"},
+	}
+	doc, err := Render(p)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+
+	parts := parseParts(t, doc)
+	if len(parts) != 3 {
+		t.Fatalf("got %d parts, want 3", len(parts))
+	}
+	if parts[0].mimeType != "text/cloud-config" || !strings.HasPrefix(parts[0].content, "#cloud-config\n") {
+		t.Errorf("first part = %s %.20q, want mayfly's cloud-config", parts[0].mimeType, parts[0].content)
+	}
+	if parts[1].mimeType != "text/cloud-config" || parts[1].filename != "org.yaml" || parts[1].mergeType != appendMergeType {
+		t.Errorf("second part = %+v, want org.yaml merged into mayfly's cloud-config", parts[1])
+	}
+	if parts[2].mimeType != "text/x-shellscript" || parts[2].content != "#!/bin/sh\necho hello" {
+		t.Errorf("third part = %+v, want agent.sh as a shell script", parts[2])
+	}
+}
+
+func TestRenderRejectsBadParts(t *testing.T) {
+	tests := map[string]Part{
+		"unknown type":  {Name: "notes.txt", Content: "remember the milk\n"},
+		"boundary":      {Name: "evil.sh", Content: "#!/bin/sh\n--" + boundary + "\n"},
+		"empty content": {Name: "empty", Content: ""},
+	}
+	for name, part := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := goldenParams(AL2023)
+			p.Append = []Part{part}
+			if _, err := Render(p); err == nil {
+				t.Error("Render accepted the part")
+			}
+		})
+	}
+}
+
+func TestReadPart(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "extra.yaml")
+	if err := os.WriteFile(good, []byte("#cloud-config\npackages: [htop]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	part, err := ReadPart(good)
+	if err != nil {
+		t.Fatalf("ReadPart: %v", err)
+	}
+	if part.Name != "extra.yaml" {
+		t.Errorf("Name = %q, want extra.yaml", part.Name)
+	}
+
+	bad := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(bad, []byte("hello\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadPart(bad); err == nil {
+		t.Error("ReadPart accepted a file cloud-init won't recognise")
+	}
+}
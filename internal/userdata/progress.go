@@ -0,0 +1,70 @@
+package userdata
+
+import (
+	"slices"
+	"strings"
+)
+
+// Stages the bootstrap script reports on the serial console, in order.
+const (
+	StageForwarding = "forwarding-enabled"
+	StageInstalled  = "tailscale-installed"
+	StageAuthKey    = "auth-key-fetched"
+	StageJoined     = "joined"
+	StageExitNode   = "exit-node-advertised"
+)
+
+// Markers the bootstrap script writes to the serial console.
+const (
+	stageMarker  = "mayfly-stage: "
+	failedMarker = "mayfly-failed: "
+	logMarker    = "mayfly-log: "
+)
+
+var stageDescriptions = map[string]string{
+	StageForwarding: "IP forwarding enabled",
+	StageInstalled:  "Tailscale installed",
+	StageAuthKey:    "Auth key fetched",
+	StageJoined:     "Joined the tailnet",
+	StageExitNode:   "Exit node advertised",
+}
+
+// DescribeStage returns a human-readable description of a reported stage.
+func DescribeStage(stage string) string {
+	if d, ok := stageDescriptions[stage]; ok {
+		return d
+	}
+	return stage
+}
+
+// Progress is what the bootstrap script has reported so far.
+type Progress struct {
+	// Stages are the stages reached, in the order they were reported.
+	Stages []string
+	// Failure says where the script failed, e.g. "line 42". Empty unless it failed.
+	Failure string
+	// Log is the tail of the script's output, reported when it fails.
+	Log []string
+}
+
+// ParseProgress extracts the bootstrap script's progress from an instance's
+// console output. Markers may be preceded by whatever the console prefixes
+// lines with, and stages reported more than once (e.g. after a reboot) count
+// once.
+func ParseProgress(console string) Progress {
+	var p Progress
+	for line := range strings.Lines(console) {
+		line = strings.TrimRight(line, "\r\n")
+		if i := strings.Index(line, stageMarker); i >= 0 {
+			if stage := strings.TrimSpace(line[i+len(stageMarker):]); stage != "" && !slices.Contains(p.Stages, stage) {
+				p.Stages = append(p.Stages, stage)
+			}
+		} else if i := strings.Index(line, failedMarker); i >= 0 {
+			p.Failure = strings.TrimSpace(line[i+len(failedMarker):])
+			p.Log = nil
+		} else if i := strings.Index(line, logMarker); i >= 0 {
+			p.Log = append(p.Log, line[i+len(logMarker):])
+		}
+	}
+	return p
+}
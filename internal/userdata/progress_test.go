@@ -0,0 +1,34 @@
+package userdata
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseProgress(t *testing.T) {
+	console := "[    4.211] cloud-init[812]: Cloud-init v. 24.1 running\r\n" +
+		"mayfly-stage: forwarding-enabled\r\n" +
+		"[   31.007] mayfly-stage: tailscale-installed\n" +
+		"mayfly-stage: forwarding-enabled\n" +
+		"mayfly-failed: line 58\n" +
+		"mayfly-log: backend error: invalid key: unable to validate API key\n" +
+		"mayfly-log: \n"
+
+	p := ParseProgress(console)
+	if want := []string{StageForwarding, StageInstalled}; !slices.Equal(p.Stages, want) {
+		t.Errorf("Stages = %q, want %q", p.Stages, want)
+	}
+	if p.Failure != "line 58" {
+		t.Errorf("Failure = %q, want %q", p.Failure, "line 58")
+	}
+	if want := []string{"backend error: invalid key: unable to validate API key", ""}; !slices.Equal(p.Log, want) {
+		t.Errorf("Log = %q, want %q", p.Log, want)
+	}
+}
+
+func TestParseProgressNothingReported(t *testing.T) {
+	p := ParseProgress("Booting Linux...\nlogin: ")
+	if len(p.Stages) != 0 || p.Failure != "" || len(p.Log) != 0 {
+		t.Errorf("ParseProgress = %+v, want nothing", p)
+	}
+}
@@ -1,37 +1,158 @@
 package userdata
 
 import (
-	"encoding/base64"
+	"bytes"
+	"embed"
+	"encoding/json"
 	"fmt"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
 )
 
-const hostname = "mayfly-exit"
+// SelfDestructGrace is how long past the deadline the instance waits before
+// shutting itself down, so the CLI's teardown normally gets there first.
+const SelfDestructGrace = 5 * time.Minute
 
-// Hostname returns the hostname used for the Tailscale device.
-func Hostname() string {
-	return hostname
+// Operating systems with a bootstrap template. Each name is also the image a
+// provider looks up for it.
+const (
+	AL2023     = "al2023"
+	Ubuntu2404 = "ubuntu-24.04"
+	Debian12   = "debian-12"
+)
+
+// OSes returns every operating system with a bootstrap template.
+func OSes() []string {
+	return []string{AL2023, Ubuntu2404, Debian12}
+}
+
+// Supported reports whether os has a bootstrap template.
+func Supported(os string) bool {
+	return slices.Contains(OSes(), os)
+}
+
+//go:embed templates/*.tmpl
+var templateFS embed.FS
+
+// Params describe how the node joins the tailnet.
+type Params struct {
+	// OS selects the bootstrap template: one of OSes.
+	OS string
+	// AuthKey is written into the script, unless AuthKeyParameter is set.
+	AuthKey string
+	// AuthKeyParameter, if set, is the SSM parameter in Region the node
+	// fetches its auth key from with its instance role, so the key never
+	// appears in user-data.
+	AuthKeyParameter string
+	Region           string
+	Hostname         string
+	// LoginServer, if set, points tailscale at that coordination server
+	// (e.g. Headscale) instead of the Tailscale default.
+	LoginServer string
+	// Tags are advertised with --advertise-tags.
+	Tags     []string
+	Deadline time.Time
+	// TailscaleVersion is the exact release to install, e.g. "1.88.3".
+	TailscaleVersion string
+	// Append are extra cloud-init parts added after mayfly's own.
+	Append []Part
+	// EC2Metadata says the node runs on EC2, so its self-destruct timer can
+	// read the mayfly-deadline tag and spot interruption notices from
+	// instance metadata. Otherwise the timer only has Deadline.
+	EC2Metadata bool
+}
+
+// packages are installed by cloud-init before the bootstrap script runs.
+// curl fetches the Tailscale repository and instance metadata; Amazon Linux
+// ships it already.
+var packages = map[string][]string{
+	Ubuntu2404: {"curl"},
+	Debian12:   {"curl"},
+}
+
+// templateData is what the bootstrap and cloud-config templates render from.
+type templateData struct {
+	Params
+	GraceSeconds int
+	Packages     []string
+	// GetAuthKey and DeleteAuthKey are the JSON bodies of the SSM requests
+	// that fetch and delete AuthKeyParameter.
+	GetAuthKey    string
+	DeleteAuthKey string
+	// Bootstrap is the rendered bootstrap script, which the cloud-config
+	// writes out and runs.
+	Bootstrap string
 }
 
-// Generate returns a base64-encoded user-data script that installs Tailscale
-// and joins the tailnet as an exit node.
-func Generate(authKey string) string {
-	script := fmt.Sprintf(`#!/bin/bash
-set -euo pipefail
+// Render returns the user-data for a node running p.OS: a multipart MIME
+// document whose first part is mayfly's #cloud-config, followed by the parts
+// in p.Append. The caller checks it fits the provider's user-data limit.
+//
+// The cloud-config enables IP forwarding and installs a timer that leaves the
+// tailnet and shuts the instance down once the deadline (plus
+// SelfDestructGrace) has passed, so the TTL holds even if the CLI is gone.
+// The same timer leaves the tailnet as soon as a spot interruption notice
+// arrives, ahead of the instance being reclaimed. It then runs the bootstrap
+// script, which installs the pinned Tailscale release from its signed
+// package repository and joins the tailnet as an exit node under the given
+// hostname, reporting its progress on the serial console (see
+// ParseProgress).
+//
+// Each value in p is checked against the characters it may contain and is
+// shell-quoted where the script uses it.
+func Render(p Params) (string, error) {
+	if !Supported(p.OS) {
+		return "", fmt.Errorf("no bootstrap template for %q (want one of %s)", p.OS, strings.Join(OSes(), ", "))
+	}
+	if err := p.validate(); err != nil {
+		return "", err
+	}
 
-# Enable IP forwarding
-cat >> /etc/sysctl.d/99-tailscale.conf <<SYSCTL
-net.ipv4.ip_forward = 1
-net.ipv6.conf.all.forwarding = 1
-SYSCTL
-sysctl -p /etc/sysctl.d/99-tailscale.conf
+	tmpl, err := template.New("").Funcs(funcs).ParseFS(templateFS, "templates/report.tmpl", "templates/authkey.tmpl", "templates/up.tmpl",
+		"templates/signingkey.tmpl", "templates/"+p.OS+".install.tmpl", "templates/"+p.OS+".sh.tmpl", "templates/cloud-config.tmpl")
+	if err != nil {
+		return "", fmt.Errorf("parsing %s template: %w", p.OS, err)
+	}
 
-# Install Tailscale
-curl -fsSL https://tailscale.com/install.sh | sh
+	data := templateData{
+		Params:       p,
+		GraceSeconds: int(SelfDestructGrace.Seconds()),
+		Packages:     packages[p.OS],
+	}
+	if p.AuthKeyParameter != "" {
+		get, err := json.Marshal(map[string]any{"Name": p.AuthKeyParameter, "WithDecryption": true})
+		if err != nil {
+			return "", fmt.Errorf("encoding auth key request: %w", err)
+		}
+		del, err := json.Marshal(map[string]any{"Name": p.AuthKeyParameter})
+		if err != nil {
+			return "", fmt.Errorf("encoding auth key request: %w", err)
+		}
+		data.GetAuthKey, data.DeleteAuthKey = string(get), string(del)
+	}
+	var script, config bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&script, p.OS+".sh.tmpl", data); err != nil {
+		return "", fmt.Errorf("rendering %s template: %w", p.OS, err)
+	}
+	data.Bootstrap = script.String()
+	if err := tmpl.ExecuteTemplate(&config, "cloud-config.tmpl", data); err != nil {
+		return "", fmt.Errorf("rendering cloud-config: %w", err)
+	}
 
-# Start and connect
-systemctl enable --now tailscaled
-tailscale up --authkey=%s --advertise-exit-node --hostname=%s
-`, authKey, hostname)
+	parts := []mimePart{{filename: "mayfly.yaml", mimeType: "text/cloud-config", content: config.String()}}
+	for _, extra := range p.Append {
+		mimeType, err := extra.contentType()
+		if err != nil {
+			return "", err
+		}
+		part := mimePart{filename: extra.Name, mimeType: mimeType, content: extra.Content}
+		if mimeType == "text/cloud-config" {
+			part.mergeType = appendMergeType
+		}
+		parts = append(parts, part)
+	}
 
-	return base64.StdEncoding.EncodeToString([]byte(script))
+	return mimeDocument(parts)
 }
@@ -0,0 +1,185 @@
+package userdata
+
+import (
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func goldenParams(name string) Params {
+	return Params{
+		OS:               name,
+		AuthKey:          "tskey-auth-golden",
+		Hostname:         "mayfly-us-east-1-abc123",
+		LoginServer:      "https://headscale.example.com",
+		Tags:             []string{"tag:exit", "tag:mayfly"},
+		Deadline:         time.Unix(1767236400, 0),
+		TailscaleVersion: "1.88.3",
+		EC2Metadata:      true,
+	}
+}
+
+func TestRenderGolden(t *testing.T) {
+	for _, name := range OSes() {
+		t.Run(name, func(t *testing.T) {
+			got, err := Render(goldenParams(name))
+			if err != nil {
+				t.Fatalf("Render: %v", err)
+			}
+
+			checkGolden(t, filepath.Join("testdata", name+".golden"), got)
+		})
+	}
+}
+
+// checkGolden compares got with the golden file, rewriting it under -update.
+func checkGolden(t *testing.T, golden, got string) {
+	t.Helper()
+	if *update {
+		if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("reading golden file (run with -update to create it): %v", err)
+	}
+	if got != string(want) {
+		t.Errorf("output differs from %s; rerun with -update if the change is intended\n--- got ---\n%s", golden, got)
+	}
+}
+
+func TestRenderFetchesAuthKeyParameter(t *testing.T) {
+	p := goldenParams(Ubuntu2404)
+	p.AuthKey = ""
+	p.AuthKeyParameter = "/mayfly/mayfly-us-east-1-abc123/auth-key"
+	p.Region = "us-east-1"
+	got, err := Render(p)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	checkGolden(t, filepath.Join("testdata", "ubuntu-24.04.parameter.golden"), got)
+
+	if strings.Contains(got, "tskey-") {
+		t.Error("user-data contains an auth key")
+	}
+	if args := bashArgs(t, upLine(t, got)); args[1] != "--authkey=file:/run/mayfly/auth-key" {
+		t.Errorf("tailscale up %q, want the key read from the fetched file", args[1:])
+	}
+
+	p.AuthKey = "tskey-auth-golden"
+	if _, err := Render(p); err == nil {
+		t.Error("Render accepted both an auth key and a parameter")
+	}
+}
+
+func TestRenderWithoutEC2Metadata(t *testing.T) {
+	p := goldenParams(Ubuntu2404)
+	p.EC2Metadata = false
+	got, err := Render(p)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	checkGolden(t, filepath.Join("testdata", "ubuntu-24.04.hetzner.golden"), got)
+
+	if strings.Contains(got, "169.254.169.254") {
+		t.Error("user-data queries EC2 instance metadata")
+	}
+	if !strings.Contains(got, "deadline=1767236400") || !strings.Contains(got, "shutdown -h now") {
+		t.Error("user-data has no self-destruct at the launch deadline")
+	}
+}
+
+func TestRenderUnknownOS(t *testing.T) {
+	if _, err := Render(goldenParams("windows-2022")); err == nil {
+		t.Error("Render succeeded for an OS without a template")
+	}
+}
+
+// pipeToShell matches a download piped straight into a shell, e.g.
+// "curl -fsSL https://tailscale.com/install.sh | sh".
+var pipeToShell = regexp.MustCompile(`(curl|wget)[^\n|]*\|\s*(sudo\s+)?(ba|da)?sh\b`)
+
+func TestRenderPinsTailscale(t *testing.T) {
+	for _, name := range OSes() {
+		t.Run(name, func(t *testing.T) {
+			script, err := Render(goldenParams(name))
+			if err != nil {
+				t.Fatalf("Render: %v", err)
+			}
+			if m := pipeToShell.FindString(script); m != "" {
+				t.Errorf("script pipes a download into a shell: %q", m)
+			}
+			if !strings.Contains(script, "pkgs.tailscale.com/stable/") {
+				t.Error("script does not use the Tailscale package repository")
+			}
+			if !strings.Contains(script, `test "$(tailscale version | head -n1)" = "1.88.3"`) {
+				t.Error("script does not verify the installed version")
+			}
+		})
+	}
+}
+
+func TestRenderChecksSigningKey(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	for _, name := range OSes() {
+		t.Run(name, func(t *testing.T) {
+			script, err := Render(goldenParams(name))
+			if err != nil {
+				t.Fatalf("Render: %v", err)
+			}
+			image, err := RenderImage(ImageParams{OS: name, TailscaleVersion: "1.88.3"})
+			if err != nil {
+				t.Fatalf("RenderImage: %v", err)
+			}
+
+			for _, script := range []string{script, image} {
+				var check string
+				var trusted int // line of the first step that trusts the downloaded key
+				for i, line := range strings.Split(script, "\n") {
+					switch {
+					case strings.Contains(line, "gpg --show-keys"):
+						check = line
+						if trusted != 0 {
+							t.Errorf("the key is trusted on line %d, before it is checked on line %d", trusted, i+1)
+						}
+					case trusted == 0 && (strings.HasPrefix(line, "rpm --import") || strings.Contains(line, "tailscale.list") || strings.Contains(line, "tailscale.repo")):
+						trusted = i + 1
+					}
+				}
+				if check == "" {
+					t.Fatalf("script does not check the signing key's fingerprint:\n%s", script)
+				}
+
+				// Run the check with gpg stubbed out to list the given keys.
+				pinned := "pub:-:4096:1:458CA832957F5868:1577836800:::-:::scESC::::::23::0:\nfpr:::::::::" + tailscaleKeyFingerprint + ":\n" +
+					"sub:-:4096:1:0123456789ABCDEF:1577836800::::::e::::::23:\nfpr:::::::::0000000000000000000000000123456789ABCDEF:\n"
+				other := "pub:-:4096:1:89ABCDEF01234567:1577836800:::-:::scESC::::::23::0:\nfpr:::::::::FFFFFFFFFFFFFFFFFFFFFFFF89ABCDEF01234567:\n"
+				for keys, want := range map[string]bool{pinned: true, other: false, pinned + other: false, "": false} {
+					cmd := exec.Command("bash", "-c", "gpg() { printf '%s' \"$KEYS\"; }\n"+check)
+					cmd.Env = append(os.Environ(), "KEYS="+keys)
+					if got := cmd.Run() == nil; got != want {
+						t.Errorf("check passed = %t for keys\n%s", got, keys)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRenderRejectsBadVersion(t *testing.T) {
+	p := goldenParams(AL2023)
+	p.TailscaleVersion = "latest"
+	if _, err := Render(p); err == nil {
+		t.Error("Render accepted an unpinned Tailscale version")
+	}
+}
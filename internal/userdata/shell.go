@@ -0,0 +1,100 @@
+package userdata
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// funcs are available to every template. Values from outside the template
+// are passed to the shell through shquote, never spliced in bare.
+var funcs = template.FuncMap{
+	"shquote": shellQuote,
+	"join":    strings.Join,
+	"indent":  indent,
+
+	"tailscaleKeyFingerprint": func() string { return tailscaleKeyFingerprint },
+}
+
+// shellQuote returns s as a single shell word that expands to exactly s:
+// wrapped in single quotes, with each embedded single quote closed, escaped
+// and reopened.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// indent prefixes each non-empty line of s with n spaces, e.g. to embed a
+// file in a YAML block scalar. A trailing newline is dropped.
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = pad + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// The characters each input may contain. They are quoted regardless; these
+// catch mistakes and keep the script readable.
+var (
+	authKeyPattern   = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+	parameterPattern = regexp.MustCompile(`^/[A-Za-z0-9_./-]{1,1000}$`)
+	regionPattern    = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+	hostnamePattern  = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,41}[a-z0-9])?$`)
+	tagPattern       = regexp.MustCompile(`^tag:[A-Za-z][A-Za-z0-9-]{0,62}$`)
+	urlPattern       = regexp.MustCompile(`^[A-Za-z0-9:/._~%-]{1,256}$`)
+)
+
+// validate checks each value the bootstrap script passes to the shell.
+func (p Params) validate() error {
+	if p.AuthKeyParameter != "" {
+		if p.AuthKey != "" {
+			return fmt.Errorf("set either an auth key or the parameter to fetch it from, not both")
+		}
+		if !parameterPattern.MatchString(p.AuthKeyParameter) {
+			return fmt.Errorf("auth key parameter %q must be a path of letters, digits, '_', '.', '-' or '/'", p.AuthKeyParameter)
+		}
+		if !regionPattern.MatchString(p.Region) {
+			return fmt.Errorf("region %q must look like us-east-1", p.Region)
+		}
+	} else if !authKeyPattern.MatchString(p.AuthKey) {
+		return fmt.Errorf("auth key must be 1-128 letters, digits, '-' or '_'")
+	}
+	if !hostnamePattern.MatchString(p.Hostname) {
+		return fmt.Errorf("hostname %q must be a DNS label of at most 43 lowercase letters, digits and '-', leaving room for the instance ID", p.Hostname)
+	}
+	if p.LoginServer != "" {
+		if err := ValidateLoginServer(p.LoginServer); err != nil {
+			return err
+		}
+	}
+	for _, tag := range p.Tags {
+		if err := ValidateTag(tag); err != nil {
+			return err
+		}
+	}
+	return ValidateTailscaleVersion(p.TailscaleVersion)
+}
+
+// ValidateTag checks that tag is an ACL tag such as "tag:exit".
+func ValidateTag(tag string) error {
+	if !tagPattern.MatchString(tag) {
+		return fmt.Errorf("tag %q must be \"tag:\" followed by a letter, then letters, digits or '-'", tag)
+	}
+	return nil
+}
+
+// ValidateLoginServer checks that s is a plain http(s) URL, without
+// credentials, query or fragment.
+func ValidateLoginServer(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || !urlPattern.MatchString(s) || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" ||
+		u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("login server %q must be a plain http(s) URL", s)
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// mayfly tells whether another process still manages a node with Unix file
+// locks and stops it with SIGTERM, neither of which Windows has, so it
+// refuses to run there rather than lose track of nodes.
+func main() {
+	fmt.Fprintln(os.Stderr, "Error: mayfly does not run on Windows; use WSL instead")
+	os.Exit(1)
+}